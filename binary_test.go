@@ -2,9 +2,12 @@ package dmx_test
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"log"
 	"os"
 	"path"
+	"strconv"
 	"testing"
 
 	"github.com/baldurstod/go-dmx"
@@ -19,7 +22,7 @@ func TestSerializeBinary(t *testing.T) {
 	root.CreateBoolAttribute("bool_attrib_false", false)
 	root.CreateBoolAttribute("bool_attrib_true", true)
 	root.CreateStringAttribute("string_attrib", "this is a string")
-	root.CreateTimeAttribute("time_attrib", 123)
+	root.CreateTimeAttribute("time_attrib", dmx.DmTimeFromSeconds(123))
 	root.CreateColorAttribute("color_attrib", [...]byte{1, 2, 3, 4})
 	root.CreateVector2Attribute("vec2_attrib", [...]float32{1.414, 3.14})
 	root.CreateVector3Attribute("vec3_attrib", [...]float32{1.23, 4.56, 7.89})
@@ -63,9 +66,9 @@ func TestSerializeBinary(t *testing.T) {
 	stringArray.PushString("this is string 3")
 
 	timeArray := root.CreateAttribute("time_array_attrib", dmx.AT_TIME_ARRAY)
-	timeArray.PushTime(1)
-	timeArray.PushTime(2)
-	timeArray.PushTime(3)
+	timeArray.PushTime(dmx.DmTimeFromSeconds(1))
+	timeArray.PushTime(dmx.DmTimeFromSeconds(2))
+	timeArray.PushTime(dmx.DmTimeFromSeconds(3))
 
 	colorArray := root.CreateAttribute("color_array_attrib", dmx.AT_COLOR_ARRAY)
 	colorArray.PushColor([...]byte{1, 2, 3, 4})
@@ -117,7 +120,7 @@ func TestSerializeBinary2(t *testing.T) {
 	root.CreateBoolAttribute("bool_attrib_false", false)
 	root.CreateBoolAttribute("bool_attrib_true", true)
 	root.CreateStringAttribute("string_attrib", "this is a string")
-	root.CreateTimeAttribute("time_attrib", 123)
+	root.CreateTimeAttribute("time_attrib", dmx.DmTimeFromSeconds(123))
 	root.CreateColorAttribute("color_attrib", [...]byte{1, 2, 3, 4})
 	root.CreateVector2Attribute("vec2_attrib", [...]float32{1.414, 3.14})
 	root.CreateVector3Attribute("vec3_attrib", [...]float32{1.23, 4.56, 7.89})
@@ -161,9 +164,9 @@ func TestSerializeBinary2(t *testing.T) {
 	stringArray.PushString("this is string 3")
 
 	timeArray := root.CreateAttribute("time_array_attrib", dmx.AT_TIME_ARRAY)
-	timeArray.PushTime(1)
-	timeArray.PushTime(2)
-	timeArray.PushTime(3)
+	timeArray.PushTime(dmx.DmTimeFromSeconds(1))
+	timeArray.PushTime(dmx.DmTimeFromSeconds(2))
+	timeArray.PushTime(dmx.DmTimeFromSeconds(3))
 
 	colorArray := root.CreateAttribute("color_array_attrib", dmx.AT_COLOR_ARRAY)
 	colorArray.PushColor([...]byte{1, 2, 3, 4})
@@ -202,3 +205,326 @@ func TestSerializeBinary2(t *testing.T) {
 
 	os.WriteFile(path.Join("./var/", "test_session.dmx"), buf.Bytes(), 0666)
 }
+
+func TestUnserializeBinary(t *testing.T) {
+	root := dmx.NewDmElement("test_DmElement", "DmElement")
+	root.CreateIntAttribute("int_attrib", 1234)
+	root.CreateFloatAttribute("float_attrib", 123.456)
+	root.CreateBoolAttribute("bool_attrib", true)
+	root.CreateStringAttribute("string_attrib", "this is a string")
+	root.CreateTimeAttribute("time_attrib", dmx.DmTimeFromSeconds(1.5))
+	root.CreateVector3Attribute("vec3_attrib", [...]float32{1.23, 4.56, 7.89})
+	root.CreateUint64Attribute("uint64_attrib", 18446744073709551)
+	elem := dmx.NewDmElement("shared_DmElement", "DmElement")
+	root.CreateElementAttribute("element_1", elem)
+	root.CreateElementAttribute("element_2", elem)
+	root.CreateElementAttribute("nil_element", nil)
+
+	elemArray := root.CreateAttribute("element_array_attrib", dmx.AT_ELEMENT_ARRAY)
+	elemArray.PushElement(dmx.NewDmElement("child_DmElement", "DmElement"))
+	elemArray.PushElement(elem)
+
+	stringArray := root.CreateAttribute("string_array_attrib", dmx.AT_STRING_ARRAY)
+	stringArray.PushString("this is string 1")
+	stringArray.PushString("this is string 2")
+
+	buf := new(bytes.Buffer)
+	if err := dmx.SerializeBinary(buf, root, "sfm_session", 22); err != nil {
+		t.Fatal(err)
+	}
+
+	root2, format, formatVersion, err := dmx.UnserializeBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if format != "sfm_session" || formatVersion != 22 {
+		t.Error("wrong format", format, formatVersion)
+	}
+
+	if root2.Name != root.Name || root2.GetType() != root.GetType() || root2.GetId() != root.GetId() {
+		t.Error("wrong root element")
+	}
+
+	if v := root2.CreateAttribute("int_attrib", dmx.AT_INT).GetValue(); v != int32(1234) {
+		t.Error("wrong int value", v)
+	}
+	if v := root2.CreateAttribute("string_attrib", dmx.AT_STRING).GetValue(); v != "this is a string" {
+		t.Error("wrong string value", v)
+	}
+	if v := root2.CreateAttribute("time_attrib", dmx.AT_TIME).GetValue(); v != dmx.DmTimeFromSeconds(1.5) {
+		t.Error("wrong time value", v)
+	}
+
+	e1 := root2.CreateAttribute("element_1", dmx.AT_ELEMENT).GetValue().(*dmx.DmElement)
+	e2 := root2.CreateAttribute("element_2", dmx.AT_ELEMENT).GetValue().(*dmx.DmElement)
+	if e1 == nil || e1 != e2 || e1.GetId() != elem.GetId() {
+		t.Error("shared element not resolved")
+	}
+	if v := root2.CreateAttribute("nil_element", dmx.AT_ELEMENT).GetValue().(*dmx.DmElement); v != nil {
+		t.Error("nil element not preserved")
+	}
+
+	a := root2.CreateAttribute("element_array_attrib", dmx.AT_ELEMENT_ARRAY).GetValue().([]*dmx.DmElement)
+	if len(a) != 2 || a[1] != e1 {
+		t.Error("wrong element array", a)
+	}
+
+	s := root2.CreateAttribute("string_array_attrib", dmx.AT_STRING_ARRAY).GetValue().([]string)
+	if len(s) != 2 || s[1] != "this is string 2" {
+		t.Error("wrong string array", s)
+	}
+}
+
+func TestSerializeBinaryVersions(t *testing.T) {
+	for _, encodingVersion := range []int{1, 2, 3, 4, 5, 9} {
+		root := dmx.NewDmElement("test_DmElement", "DmElement")
+		root.CreateIntAttribute("int_attrib", 1234)
+		root.CreateStringAttribute("string_attrib", "this is a string")
+		root.CreateVector3Attribute("vec3_attrib", [...]float32{1.23, 4.56, 7.89})
+		child := dmx.NewDmElement("child_DmElement", "DmeModel")
+		child.CreateStringAttribute("string_attrib", "this is another string")
+		root.CreateElementAttribute("child", child)
+
+		floatArray := root.CreateAttribute("float_array_attrib", dmx.AT_FLOAT_ARRAY)
+		floatArray.PushFloat(1.414)
+		floatArray.PushFloat(2.718)
+
+		buf := new(bytes.Buffer)
+		if err := dmx.SerializeBinaryVersion(buf, root, encodingVersion, "model", 1); err != nil {
+			t.Fatal(encodingVersion, err)
+		}
+
+		root2, header, err := dmx.Unserialize(buf)
+		if err != nil {
+			t.Fatal(encodingVersion, err)
+		}
+		if header.EncodingVersion != encodingVersion {
+			t.Error("wrong encoding version", header.EncodingVersion, encodingVersion)
+		}
+
+		if v := root2.CreateAttribute("string_attrib", dmx.AT_STRING).GetValue(); v != "this is a string" {
+			t.Error(encodingVersion, "wrong string value", v)
+		}
+		if v := root2.CreateAttribute("vec3_attrib", dmx.AT_VECTOR3).GetValue(); v != root.CreateAttribute("vec3_attrib", dmx.AT_VECTOR3).GetValue() {
+			t.Error(encodingVersion, "wrong vector3 value", v)
+		}
+		child2 := root2.CreateAttribute("child", dmx.AT_ELEMENT).GetValue().(*dmx.DmElement)
+		if child2 == nil || child2.Name != "child_DmElement" || child2.GetType() != "DmeModel" {
+			t.Error(encodingVersion, "wrong child element", child2)
+		}
+		if a := root2.CreateAttribute("float_array_attrib", dmx.AT_FLOAT_ARRAY).GetValue().([]float32); len(a) != 2 || a[1] != 2.718 {
+			t.Error(encodingVersion, "wrong float array", a)
+		}
+	}
+
+	root := dmx.NewDmElement("test_DmElement", "DmElement")
+	root.CreateUint64Attribute("uint64_attrib", 18446744073709551)
+	if err := dmx.SerializeBinaryVersion(new(bytes.Buffer), root, 5, "model", 1); err == nil {
+		t.Error("uint64 attributes should require version 9")
+	}
+	if err := dmx.SerializeBinaryVersion(new(bytes.Buffer), root, 7, "model", 1); err == nil {
+		t.Error("version 7 should not be supported")
+	}
+}
+
+func TestBinaryPrefix(t *testing.T) {
+	root := dmx.NewDmElement("root", "DmElement")
+	root.CreateStringAttribute("name2", "value")
+
+	document := dmx.NewDmDocument(root, dmx.DmHeader{Encoding: "binary", EncodingVersion: 9, Format: "model", FormatVersion: 22})
+	prefix := document.GetPrefix()
+	prefix.CreateStringAttribute("asset_info", "generated")
+	prefix.CreateIntAttribute("version", 3)
+	prefix.CreateAttribute("tags", dmx.AT_STRING_ARRAY).SetValue([]string{"a", "b"})
+
+	buf := new(bytes.Buffer)
+	if err := dmx.SerializeDocument(buf, document); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prefix element count, attribute count, then the first attribute with its inline name and value
+	expected := []byte("\n\x00\x01\x00\x00\x00\x03\x00\x00\x00asset_info\x00\x05generated\x00")
+	if !bytes.Contains(buf.Bytes(), expected) {
+		t.Error("wrong prefix layout")
+	}
+
+	document2, err := dmx.UnserializeDocument(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dmx.Equal(document2.GetPrefix(), prefix, dmx.CompareOptions{}) {
+		t.Error("prefix attributes not preserved")
+	}
+	if v, _ := document2.Root.GetString("name2"); v != "value" {
+		t.Error("wrong root after prefix", v)
+	}
+
+	// Round trip through the text encoding
+	document2.Header = dmx.DmHeader{Encoding: "keyvalues2", EncodingVersion: 4, Format: "model", FormatVersion: 22}
+	buf.Reset()
+	if err := dmx.SerializeDocument(buf, document2); err != nil {
+		t.Fatal(err)
+	}
+	document3, err := dmx.UnserializeDocument(buf)
+	if err != nil || !dmx.Equal(document3.GetPrefix(), prefix, dmx.CompareOptions{}) {
+		t.Error("prefix attributes not preserved in text", err)
+	}
+
+	document.Header.EncodingVersion = 5
+	if err := dmx.SerializeDocument(new(bytes.Buffer), document); err == nil {
+		t.Error("prefix attributes should require version 9")
+	}
+
+	prefix.CreateElementAttribute("element", root)
+	document.Header.EncodingVersion = 9
+	if err := dmx.SerializeDocument(new(bytes.Buffer), document); err == nil {
+		t.Error("prefix attributes should not reference elements")
+	}
+}
+
+func TestUnserializeBinaryMalformed(t *testing.T) {
+	serialize := func(root *dmx.DmElement) []byte {
+		buf := new(bytes.Buffer)
+		if err := dmx.SerializeBinary(buf, root, "model", 1); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	root := dmx.NewDmElement("root", "DmElement")
+	root.CreateAttribute("int_array", dmx.AT_INT_ARRAY).PushInt(0x11223344)
+	ints := serialize(root)
+
+	root = dmx.NewDmElement("root", "DmElement")
+	root.CreateAttribute("string_array", dmx.AT_STRING_ARRAY).PushString("abcdef")
+	strings := serialize(root)
+
+	root = dmx.NewDmElement("root", "DmElement")
+	root.CreateAttribute("element_array", dmx.AT_ELEMENT_ARRAY).PushElement(dmx.NewDmElement("child", "DmElement"))
+	elements := serialize(root)
+
+	// Array counts far larger than the file must not be allocated
+	for _, test := range []struct {
+		name string
+		file []byte
+		item []byte
+	}{
+		{"int", ints, []byte{0x44, 0x33, 0x22, 0x11}},
+		{"string", strings, []byte("abcdef\x00")},
+		{"element", elements, []byte{1, 0, 0, 0}},
+	} {
+		file := bytes.Clone(test.file)
+		i := bytes.LastIndex(file, append([]byte{1, 0, 0, 0}, test.item...))
+		if i < 0 {
+			t.Fatal("array not found", test.name)
+		}
+		copy(file[i:], []byte{0xff, 0xff, 0xff, 0x7f})
+		if _, _, err := dmx.Unserialize(bytes.NewReader(file)); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Error("wrong error for huge array count", test.name, err)
+		}
+	}
+
+	// Truncated files
+	for _, file := range [][]byte{ints, strings, elements} {
+		start := bytes.IndexByte(file, 0) + 1 // after the header terminator
+		for i := start; i < len(file); i++ {
+			if _, _, err := dmx.Unserialize(bytes.NewReader(file[:i])); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Error("wrong error for truncated file", i, err)
+			}
+		}
+	}
+
+	// Null and external entries in element arrays are kept as nil elements.
+	// The child index is followed by the child attribute count.
+	null := bytes.Clone(elements)
+	copy(null[len(null)-8:], []byte{0xff, 0xff, 0xff, 0xff})
+	external := append(bytes.Clone(elements[:len(elements)-8]), 0xfe, 0xff, 0xff, 0xff)
+	external = append(external, "f2a3b4c5-0000-4000-8000-000000000000\x00"...)
+	external = append(external, elements[len(elements)-4:]...)
+	for _, file := range [][]byte{null, external} {
+		root, _, err := dmx.Unserialize(bytes.NewReader(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a, _ := root.GetElementArray("element_array"); len(a) != 1 || a[0] != nil {
+			t.Error("null entry not kept", a)
+		}
+		for _, header := range []dmx.DmHeader{
+			{Encoding: "keyvalues2", EncodingVersion: 4, Format: "model", FormatVersion: 1},
+			{Encoding: "binary", EncodingVersion: 9, Format: "model", FormatVersion: 1},
+		} {
+			buf := new(bytes.Buffer)
+			if err := dmx.Serialize(buf, root, header); err != nil {
+				t.Fatal(err)
+			}
+			root2, _, err := dmx.Unserialize(buf)
+			if err != nil {
+				t.Fatal(header, err)
+			}
+			if a, _ := root2.GetElementArray("element_array"); len(a) != 1 || a[0] != nil {
+				t.Error("null entry not written", header, a)
+			}
+		}
+	}
+}
+
+const binaryLayoutId = "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f"
+
+func TestBinaryLayout(t *testing.T) {
+	// Hand assembled files of each binary encoding version, with a root element "root" holding
+	// an int attribute "value" = 42 and a string attribute "label" = "hi"
+	fixtures := map[int]string{
+		1: "\x01\x00\x00\x00" + // element count
+			"DmElement\x00" + "root\x00" + binaryLayoutId +
+			"\x02\x00\x00\x00" + // attribute count
+			"value\x00" + "\x02" + "\x2a\x00\x00\x00" +
+			"label\x00" + "\x05" + "hi\x00",
+		2: "\x03\x00" + "DmElement\x00" + "value\x00" + "label\x00" + // 16 bits string count
+			"\x01\x00\x00\x00" +
+			"\x00\x00" + "root\x00" + binaryLayoutId +
+			"\x02\x00\x00\x00" +
+			"\x01\x00" + "\x02" + "\x2a\x00\x00\x00" +
+			"\x02\x00" + "\x05" + "hi\x00",
+		4: "\x05\x00\x00\x00" + "DmElement\x00" + "root\x00" + "value\x00" + "label\x00" + "hi\x00" + // 32 bits string count
+			"\x01\x00\x00\x00" +
+			"\x00\x00" + "\x01\x00" + binaryLayoutId +
+			"\x02\x00\x00\x00" +
+			"\x02\x00" + "\x02" + "\x2a\x00\x00\x00" +
+			"\x03\x00" + "\x05" + "\x04\x00",
+		5: "\x05\x00\x00\x00" + "DmElement\x00" + "root\x00" + "value\x00" + "label\x00" + "hi\x00" +
+			"\x01\x00\x00\x00" +
+			"\x00\x00\x00\x00" + "\x01\x00\x00\x00" + binaryLayoutId + // 32 bits string indices
+			"\x02\x00\x00\x00" +
+			"\x02\x00\x00\x00" + "\x02" + "\x2a\x00\x00\x00" +
+			"\x03\x00\x00\x00" + "\x05" + "\x04\x00\x00\x00",
+	}
+	fixtures[3] = fixtures[2]
+	fixtures[9] = "\x00\x00\x00\x00" + fixtures[5] // prefix element count
+
+	root := dmx.NewDmElement("root", "DmElement")
+	root.SetId(dmx.DmObjectId([]byte(binaryLayoutId)))
+	root.CreateIntAttribute("value", 42)
+	root.CreateStringAttribute("label", "hi")
+
+	for encodingVersion, body := range fixtures {
+		file := "<!-- dmx encoding binary " + strconv.Itoa(encodingVersion) + " format model 1 -->\n\x00" + body
+
+		root2, _, err := dmx.Unserialize(bytes.NewBufferString(file))
+		if err != nil {
+			t.Error(encodingVersion, err)
+			continue
+		}
+		if !dmx.Equal(root2, root, dmx.CompareOptions{}) {
+			t.Error("wrong element", encodingVersion)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := dmx.SerializeBinaryVersion(buf, root, encodingVersion, "model", 1); err != nil {
+			t.Fatal(encodingVersion, err)
+		}
+		if buf.String() != file {
+			t.Errorf("wrong layout for version %d\n%q\n%q", encodingVersion, buf.String(), file)
+		}
+	}
+}
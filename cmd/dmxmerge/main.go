@@ -0,0 +1,159 @@
+// Command dmxmerge is a git merge driver for dmx files.
+//
+// It merges the attribute level changes of both sides and writes the result using the encoding of the current version.
+// Conflicting changes keep the current version and are reported on stderr, the exit code is then 1.
+//
+// To use it, add to .git/config or ~/.gitconfig:
+//
+//	[merge "dmx"]
+//		name = dmx merge driver
+//		driver = dmxmerge %O %A %B
+//
+// and to .gitattributes:
+//
+//	*.dmx merge=dmx
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/baldurstod/go-dmx"
+)
+
+func main() {
+	if len(os.Args) != 4 {
+		fmt.Fprintln(os.Stderr, "usage: dmxmerge <base> <current> <other>")
+		os.Exit(2)
+	}
+
+	conflicts, err := merge(os.Args[1], os.Args[2], os.Args[3])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dmxmerge:", err)
+		os.Exit(2)
+	}
+
+	if len(conflicts) > 0 {
+		for _, c := range conflicts {
+			fmt.Fprintf(os.Stderr, "dmxmerge: %s conflict in %s %s: base %v, ours %v, theirs %v\n", c.Kind, c.Path, c.Attribute, c.Base, c.Ours, c.Theirs)
+		}
+		os.Exit(1)
+	}
+}
+
+func merge(basePath string, currentPath string, otherPath string) ([]dmx.MergeConflict, error) {
+	base, err := read(basePath)
+	if err != nil {
+		return nil, err
+	}
+	ours, err := read(currentPath)
+	if err != nil {
+		return nil, err
+	}
+	theirs, err := read(otherPath)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, conflicts := dmx.Merge(base.Root, ours.Root, theirs.Root)
+
+	// Keep our header and prefix attributes, the elements of ours are replaced by the merged ones
+	orphans := unreachableElements(base, ours, theirs, merged)
+	ours.Root = merged
+	ours.RemoveUnreachable()
+	for _, e := range orphans {
+		ours.AddElement(e)
+	}
+
+	if err := write(currentPath, ours); err != nil {
+		return nil, err
+	}
+	return conflicts, nil
+}
+
+// unreachableElements returns the elements owned by ours that are not reachable from the merged root,
+// except the ones theirs deleted. Their references to elements of ours are replaced by the merged elements.
+func unreachableElements(base *dmx.DmDocument, ours *dmx.DmDocument, theirs *dmx.DmDocument, merged *dmx.DmElement) []*dmx.DmElement {
+	ids := func(elements []*dmx.DmElement) map[dmx.DmObjectId]struct{} {
+		m := make(map[dmx.DmObjectId]struct{}, len(elements))
+		for _, e := range elements {
+			m[e.GetId()] = struct{}{}
+		}
+		return m
+	}
+	baseIds, theirIds := ids(base.Elements()), ids(theirs.Elements())
+
+	mergedElements := make(map[dmx.DmObjectId]*dmx.DmElement)
+	for _, e := range dmx.DepthFirst(merged) {
+		mergedElements[e.GetId()] = e
+	}
+
+	orphans := make([]*dmx.DmElement, 0)
+	for _, e := range ours.Elements() {
+		id := e.GetId()
+		if _, exist := mergedElements[id]; exist {
+			continue
+		}
+		_, inBase := baseIds[id]
+		_, inTheirs := theirIds[id]
+		if inBase && !inTheirs {
+			// Deleted by theirs
+			continue
+		}
+		orphans = append(orphans, e)
+	}
+
+	for _, e := range orphans {
+		dmx.Transform(e, dmx.TransformFuncs{
+			Element: func(e *dmx.DmElement) (*dmx.DmElement, error) {
+				if m, exist := mergedElements[e.GetId()]; exist {
+					return m, nil
+				}
+				return e, nil
+			},
+		})
+	}
+	return orphans
+}
+
+// write serializes document to a temporary file renamed to path, path is left untouched on error
+func write(path string, document *dmx.DmDocument) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := dmx.SerializeDocument(f, document); err != nil {
+		return err
+	}
+	if err := f.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func read(path string) (*dmx.DmDocument, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	document, err := dmx.UnserializeDocument(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return document, nil
+}
@@ -1,8 +1,12 @@
 package dmx
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"reflect"
 	"strconv"
+	"strings"
 
 	"github.com/baldurstod/go-vector"
 )
@@ -15,8 +19,7 @@ type DmAttribute struct {
 }
 
 func newDmAttribute(name string, attributeType DmAttributeType, owner *DmElement) *DmAttribute {
-	attribute := DmAttribute{owner: owner}
-	attribute.SetName(name)
+	attribute := DmAttribute{name: name, owner: owner}
 	attribute.SetType(attributeType)
 	return &attribute
 }
@@ -25,8 +28,13 @@ func (attribute *DmAttribute) GetName() string {
 	return attribute.name
 }
 
-func (attribute *DmAttribute) SetName(name string) {
+// SetName renames the attribute, it fails if the owner already has an attribute with the same name
+func (attribute *DmAttribute) SetName(name string) error {
+	if attribute.owner != nil {
+		return attribute.owner.RenameAttribute(attribute.name, name)
+	}
 	attribute.name = name
+	return nil
 }
 
 func (attribute *DmAttribute) GetType() DmAttributeType {
@@ -37,7 +45,7 @@ func (attribute *DmAttribute) SetType(attributeType DmAttributeType) {
 	attribute.attributeType = attributeType
 	switch attributeType {
 	case AT_ELEMENT:
-		attribute.value = nil
+		attribute.value = (*DmElement)(nil)
 	case AT_INT:
 		attribute.value = int32(0)
 	case AT_FLOAT:
@@ -46,10 +54,12 @@ func (attribute *DmAttribute) SetType(attributeType DmAttributeType) {
 		attribute.value = false
 	case AT_STRING:
 		attribute.value = ""
+	case AT_VOID:
+		attribute.value = make([]byte, 0)
 	case AT_TIME:
-		attribute.value = float32(0)
+		attribute.value = DmTime(0)
 	case AT_COLOR:
-		attribute.value = [...]byte{0, 0, 0, 0}
+		attribute.value = Color{}
 	case AT_VECTOR2:
 		attribute.value = vector.Vector2[float32]{}
 	case AT_VECTOR3:
@@ -75,10 +85,12 @@ func (attribute *DmAttribute) SetType(attributeType DmAttributeType) {
 		attribute.value = make([]bool, 0)
 	case AT_STRING_ARRAY:
 		attribute.value = make([]string, 0)
+	case AT_VOID_ARRAY:
+		attribute.value = make([][]byte, 0)
 	case AT_TIME_ARRAY:
-		attribute.value = make([]float32, 0)
+		attribute.value = make([]DmTime, 0)
 	case AT_COLOR_ARRAY:
-		attribute.value = make([][4]byte, 0)
+		attribute.value = make([]Color, 0)
 	case AT_VECTOR2_ARRAY:
 		attribute.value = make([]vector.Vector2[float32], 0)
 	case AT_VECTOR3_ARRAY, AT_QANGLE_ARRAY:
@@ -96,66 +108,314 @@ func (attribute *DmAttribute) SetType(attributeType DmAttributeType) {
 	}
 }
 
+// GetValue returns the value of the attribute.
+// Color values are of type Color, they were of type [4]byte before, use Get[[4]byte] for the old representation.
 func (attribute *DmAttribute) GetValue() interface{} {
 	return attribute.value
 }
 
-func (attribute *DmAttribute) SetValue(value interface{}) {
-	//TODO: check if value is compatible with type
+// SetValue sets the value of the attribute, value must be of the exact type used to store the attribute type
+func (attribute *DmAttribute) SetValue(value interface{}) error {
+	if value == nil && attribute.attributeType == AT_ELEMENT {
+		value = (*DmElement)(nil)
+	}
+	value = normalizeValue(attribute.attributeType, value)
+
+	if err := checkValue(attribute.attributeType, value); err != nil {
+		return fmt.Errorf("attribute %s: %w", attribute.name, err)
+	}
 	attribute.value = value
+	return nil
+}
+
+// SetValues sets the items of an array attribute
+func (attribute *DmAttribute) SetValues(values ...interface{}) error {
+	if attribute.attributeType < AT_FIRST_ARRAY_TYPE {
+		return errors.New("attribute " + attribute.name + " is not an array")
+	}
+
+	itemType := arrayItemType(attribute.attributeType)
+	items := make([]interface{}, len(values))
+	for k, v := range values {
+		items[k] = normalizeValue(itemType, v)
+		if err := checkValue(itemType, items[k]); err != nil {
+			return fmt.Errorf("attribute %s: %w", attribute.name, err)
+		}
+	}
+
+	return attribute.setArray(items)
+}
+
+// SetValueLenient is like SetValue but converts value to the type used to store the attribute type when possible,
+// for instance int to int32, []float64 to []float32 or [3]float64 to vector.Vector3[float32]
+func (attribute *DmAttribute) SetValueLenient(value interface{}) error {
+	v, err := coerceValue(attribute.attributeType, value)
+	if err != nil {
+		return fmt.Errorf("attribute %s: %w", attribute.name, err)
+	}
+	attribute.value = v
+	return nil
+}
+
+// SetValuesLenient is like SetValues but converts each item like SetValueLenient
+func (attribute *DmAttribute) SetValuesLenient(values ...interface{}) error {
+	if attribute.attributeType < AT_FIRST_ARRAY_TYPE {
+		return errors.New("attribute " + attribute.name + " is not an array")
+	}
+
+	itemType := arrayItemType(attribute.attributeType)
+	items := make([]interface{}, len(values))
+	for k, v := range values {
+		item, err := coerceValue(itemType, v)
+		if err != nil {
+			return fmt.Errorf("attribute %s: %w", attribute.name, err)
+		}
+		items[k] = item
+	}
+
+	return attribute.setArray(items)
+}
+
+func (attribute *DmAttribute) setArray(values []interface{}) error {
+	if attribute.attributeType == AT_ELEMENT_ARRAY {
+		for _, v := range values {
+			if v.(*DmElement) == nil {
+				return errors.New("attribute " + attribute.name + ": element arrays can't contain nil elements")
+			}
+		}
+	}
+
+	value, err := makeArray(attribute.attributeType, values)
+	if err != nil {
+		return err
+	}
+	attribute.value = value
+	return nil
+}
+
+// Get returns the value of attribute if it is of type T.
+// Colors can also be read as [4]byte and [][4]byte.
+func Get[T any](attribute *DmAttribute) (T, error) {
+	v, ok := attribute.value.(T)
+	if !ok {
+		v, ok = legacyValue(attribute.value).(T)
+	}
+	if !ok {
+		var zero T
+		return zero, fmt.Errorf("attribute %s of type %s does not hold a value of type %T", attribute.name, type_to_string[attribute.attributeType], zero)
+	}
+	return v, nil
+}
+
+// Set sets the value of attribute if T is compatible with the attribute type
+func Set[T any](attribute *DmAttribute, value T) error {
+	v := normalizeValue(attribute.attributeType, value)
+	if err := checkValue(attribute.attributeType, v); err != nil {
+		return fmt.Errorf("attribute %s: %w", attribute.name, err)
+	}
+	attribute.value = v
+	return nil
 }
 
-func (attribute *DmAttribute) SetValues(value ...interface{}) {
-	//TODO: check if value is compatible with type
-	//attribute.value = value
+func checkValue(attributeType DmAttributeType, value interface{}) error {
+	var ok bool
+	switch attributeType {
+	case AT_ELEMENT:
+		_, ok = value.(*DmElement)
+	case AT_INT:
+		_, ok = value.(int32)
+	case AT_FLOAT:
+		_, ok = value.(float32)
+	case AT_TIME:
+		_, ok = value.(DmTime)
+	case AT_BOOL:
+		_, ok = value.(bool)
+	case AT_STRING:
+		_, ok = value.(string)
+	case AT_VOID:
+		_, ok = value.([]byte)
+	case AT_COLOR:
+		_, ok = value.(Color)
+	case AT_VECTOR2:
+		_, ok = value.(vector.Vector2[float32])
+	case AT_VECTOR3, AT_QANGLE:
+		_, ok = value.(vector.Vector3[float32])
+	case AT_VECTOR4:
+		_, ok = value.(vector.Vector4[float32])
+	case AT_QUATERNION:
+		_, ok = value.(vector.Quaternion[float32])
+	case AT_VMATRIX:
+		_, ok = value.([16]float32)
+	case AT_UINT64:
+		_, ok = value.(uint64)
+	case AT_ELEMENT_ARRAY:
+		var a []*DmElement
+		if a, ok = value.([]*DmElement); ok {
+			for _, e := range a {
+				if e == nil {
+					return errors.New("element arrays can't contain nil elements")
+				}
+			}
+		}
+	case AT_INT_ARRAY:
+		_, ok = value.([]int32)
+	case AT_FLOAT_ARRAY:
+		_, ok = value.([]float32)
+	case AT_TIME_ARRAY:
+		_, ok = value.([]DmTime)
+	case AT_BOOL_ARRAY:
+		_, ok = value.([]bool)
+	case AT_STRING_ARRAY:
+		_, ok = value.([]string)
+	case AT_VOID_ARRAY:
+		_, ok = value.([][]byte)
+	case AT_COLOR_ARRAY:
+		_, ok = value.([]Color)
+	case AT_VECTOR2_ARRAY:
+		_, ok = value.([]vector.Vector2[float32])
+	case AT_VECTOR3_ARRAY, AT_QANGLE_ARRAY:
+		_, ok = value.([]vector.Vector3[float32])
+	case AT_VECTOR4_ARRAY:
+		_, ok = value.([]vector.Vector4[float32])
+	case AT_QUATERNION_ARRAY:
+		_, ok = value.([]vector.Quaternion[float32])
+	case AT_VMATRIX_ARRAY:
+		_, ok = value.([][16]float32)
+	case AT_UINT64_ARRAY:
+		_, ok = value.([]uint64)
+	default:
+		return errors.New("unsupported attribute type " + type_to_string[attributeType])
+	}
+
+	if !ok {
+		return fmt.Errorf("value of type %T is not compatible with attribute type %s", value, type_to_string[attributeType])
+	}
+	return nil
+}
+
+// makeArray converts values to the slice type used to store attributeType, values must be of the item type
+func makeArray(attributeType DmAttributeType, values []interface{}) (interface{}, error) {
+	switch attributeType {
+	case AT_ELEMENT_ARRAY:
+		return toArray[*DmElement](values)
+	case AT_INT_ARRAY:
+		return toArray[int32](values)
+	case AT_FLOAT_ARRAY:
+		return toArray[float32](values)
+	case AT_TIME_ARRAY:
+		return toArray[DmTime](values)
+	case AT_BOOL_ARRAY:
+		return toArray[bool](values)
+	case AT_STRING_ARRAY:
+		return toArray[string](values)
+	case AT_VOID_ARRAY:
+		return toArray[[]byte](values)
+	case AT_COLOR_ARRAY:
+		return toArray[Color](values)
+	case AT_VECTOR2_ARRAY:
+		return toArray[vector.Vector2[float32]](values)
+	case AT_VECTOR3_ARRAY, AT_QANGLE_ARRAY:
+		return toArray[vector.Vector3[float32]](values)
+	case AT_VECTOR4_ARRAY:
+		return toArray[vector.Vector4[float32]](values)
+	case AT_QUATERNION_ARRAY:
+		return toArray[vector.Quaternion[float32]](values)
+	case AT_VMATRIX_ARRAY:
+		return toArray[[16]float32](values)
+	case AT_UINT64_ARRAY:
+		return toArray[uint64](values)
+	default:
+		return nil, errors.New("unsupported array type " + type_to_string[attributeType])
+	}
+}
+
+func toArray[T any](values []interface{}) ([]T, error) {
+	a := make([]T, len(values))
+	for k, v := range values {
+		item, ok := v.(T)
+		if !ok {
+			return nil, fmt.Errorf("array item of type %T is not of type %T", v, item)
+		}
+		a[k] = item
+	}
+	return a, nil
 }
 
 func (attribute *DmAttribute) GetOwner() *DmElement {
 	return attribute.owner
 }
 
+// StringValue returns the value as written in keyvalues2 files.
+// Elements are formatted as their id and arrays as [item, item].
 func (attribute *DmAttribute) StringValue() string {
-	switch attribute.attributeType {
+	return valueToString(attribute.attributeType, attribute.value)
+}
+
+func valueToString(attributeType DmAttributeType, value interface{}) string {
+	if attributeType >= AT_FIRST_ARRAY_TYPE {
+		v := reflect.ValueOf(value)
+		if v.Kind() != reflect.Slice {
+			return ""
+		}
+
+		itemType := arrayItemType(attributeType)
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = valueToString(itemType, v.Index(i).Interface())
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+
+	switch attributeType {
+	case AT_ELEMENT:
+		if e, ok := value.(*DmElement); ok && e != nil {
+			return FormatObjectId(e.id)
+		}
+		return ""
 	case AT_INT:
-		return strconv.FormatInt(int64(attribute.value.(int32)), 10)
-	case AT_FLOAT, AT_TIME: // Time is stored as a float in txt version
-		return strconv.FormatFloat(float64(attribute.value.(float32)), 'g', -1, 32)
+		return strconv.FormatInt(int64(value.(int32)), 10)
+	case AT_FLOAT:
+		return strconv.FormatFloat(float64(value.(float32)), 'g', -1, 32)
+	case AT_TIME:
+		return value.(DmTime).String()
 	case AT_BOOL:
-		if attribute.value.(bool) {
+		if value.(bool) {
 			return "1"
 		} else {
 			return "0"
 		}
 	case AT_STRING:
-		return attribute.value.(string)
+		return value.(string)
+	case AT_VOID:
+		return strings.ToUpper(hex.EncodeToString(value.([]byte)))
 	case AT_COLOR:
-		v := attribute.value.([4]byte)
+		v := value.(Color)
 		c := fmt.Sprintf("%d %d %d %d", v[0], v[1], v[2], v[3])
 		return c
 	case AT_VECTOR2:
-		v := attribute.value.(vector.Vector2[float32])
+		v := value.(vector.Vector2[float32])
 		c := fmt.Sprintf("%g %g", v[0], v[1])
 		return c
 	case AT_VECTOR3, AT_QANGLE:
-		v := attribute.value.(vector.Vector3[float32])
+		v := value.(vector.Vector3[float32])
 		c := fmt.Sprintf("%g %g %g", v[0], v[1], v[2])
 		return c
 	case AT_VECTOR4:
-		v := attribute.value.(vector.Vector4[float32])
+		v := value.(vector.Vector4[float32])
 		c := fmt.Sprintf("%g %g %g %g", v[0], v[1], v[2], v[3])
 		return c
 	case AT_QUATERNION:
-		q := attribute.value.(vector.Quaternion[float32])
+		q := value.(vector.Quaternion[float32])
 		c := fmt.Sprintf("%g %g %g %g", q[0], q[1], q[2], q[3])
 		return c
 	case AT_VMATRIX:
-		v := attribute.value.([16]float32)
+		v := value.([16]float32)
 		c := fmt.Sprintf("%g %g %g %g %g %g %g %g %g %g %g %g %g %g %g %g", v[0], v[1], v[2], v[3], v[4], v[5], v[6], v[7], v[8], v[9], v[10], v[11], v[12], v[13], v[14], v[15])
 		return c
 	case AT_UINT64:
-		return strconv.FormatUint(attribute.value.(uint64), 10)
+		return strconv.FormatUint(value.(uint64), 10)
 	default:
-		panic("Unknown attribute type in StringValue " + type_to_string[attribute.attributeType])
+		return ""
 	}
 }
 
@@ -187,13 +447,18 @@ func (attribute *DmAttribute) PushString(s string) {
 	attribute.value = append(a, s)
 }
 
-func (attribute *DmAttribute) PushTime(t float32) {
-	a := attribute.value.([]float32)
+func (attribute *DmAttribute) PushBinary(b []byte) {
+	v := attribute.value.([][]byte)
+	attribute.value = append(v, b)
+}
+
+func (attribute *DmAttribute) PushTime(t DmTime) {
+	a := attribute.value.([]DmTime)
 	attribute.value = append(a, t)
 }
 
-func (attribute *DmAttribute) PushColor(v [4]byte) {
-	a := attribute.value.([][4]byte)
+func (attribute *DmAttribute) PushColor(v Color) {
+	a := attribute.value.([]Color)
 	attribute.value = append(a, v)
 }
 
@@ -217,7 +482,102 @@ func (attribute *DmAttribute) PushQuaternion(v vector.Quaternion[float32]) {
 	attribute.value = append(a, v)
 }
 
+func (attribute *DmAttribute) PushQAngle(v vector.Vector3[float32]) {
+	a := attribute.value.([]vector.Vector3[float32])
+	attribute.value = append(a, v)
+}
+
+func (attribute *DmAttribute) PushMatrix(m [16]float32) {
+	a := attribute.value.([][16]float32)
+	attribute.value = append(a, m)
+}
+
 func (attribute *DmAttribute) PushUint64(i uint64) {
 	a := attribute.value.([]uint64)
 	attribute.value = append(a, i)
 }
+
+// Len returns the number of items of an array attribute, or 0 if the attribute is not an array
+func (attribute *DmAttribute) Len() int {
+	if attribute.attributeType < AT_FIRST_ARRAY_TYPE {
+		return 0
+	}
+	return reflect.ValueOf(attribute.value).Len()
+}
+
+func (attribute *DmAttribute) checkIndex(index int, length int) error {
+	if attribute.attributeType < AT_FIRST_ARRAY_TYPE {
+		return errors.New("attribute " + attribute.name + " is not an array")
+	}
+	if index < 0 || index >= length {
+		return fmt.Errorf("attribute %s: index %d out of range [0, %d)", attribute.name, index, length)
+	}
+	return nil
+}
+
+func (attribute *DmAttribute) checkItem(value interface{}) error {
+	itemType := arrayItemType(attribute.attributeType)
+	if err := checkValue(itemType, value); err != nil {
+		return fmt.Errorf("attribute %s: %w", attribute.name, err)
+	}
+	if itemType == AT_ELEMENT && value.(*DmElement) == nil {
+		return errors.New("attribute " + attribute.name + ": element arrays can't contain nil elements")
+	}
+	return nil
+}
+
+// At returns the item index of an array attribute
+func (attribute *DmAttribute) At(index int) (interface{}, error) {
+	if err := attribute.checkIndex(index, attribute.Len()); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(attribute.value).Index(index).Interface(), nil
+}
+
+// SetAt replaces the item index of an array attribute, value must be of the exact item type
+func (attribute *DmAttribute) SetAt(index int, value interface{}) error {
+	if err := attribute.checkIndex(index, attribute.Len()); err != nil {
+		return err
+	}
+	value = normalizeValue(arrayItemType(attribute.attributeType), value)
+	if err := attribute.checkItem(value); err != nil {
+		return err
+	}
+	reflect.ValueOf(attribute.value).Index(index).Set(reflect.ValueOf(value))
+	return nil
+}
+
+// InsertAt inserts value before the item index of an array attribute, index can be the length of the array
+func (attribute *DmAttribute) InsertAt(index int, value interface{}) error {
+	length := attribute.Len()
+	if err := attribute.checkIndex(index, length+1); err != nil {
+		return err
+	}
+	value = normalizeValue(arrayItemType(attribute.attributeType), value)
+	if err := attribute.checkItem(value); err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(attribute.value)
+	a := reflect.MakeSlice(v.Type(), 0, length+1)
+	a = reflect.AppendSlice(a, v.Slice(0, index))
+	a = reflect.Append(a, reflect.ValueOf(value))
+	a = reflect.AppendSlice(a, v.Slice(index, length))
+	attribute.value = a.Interface()
+	return nil
+}
+
+// RemoveAt removes the item index of an array attribute
+func (attribute *DmAttribute) RemoveAt(index int) error {
+	length := attribute.Len()
+	if err := attribute.checkIndex(index, length); err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(attribute.value)
+	a := reflect.MakeSlice(v.Type(), 0, length-1)
+	a = reflect.AppendSlice(a, v.Slice(0, index))
+	a = reflect.AppendSlice(a, v.Slice(index+1, length))
+	attribute.value = a.Interface()
+	return nil
+}
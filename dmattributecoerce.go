@@ -0,0 +1,239 @@
+package dmx
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/baldurstod/go-vector"
+)
+
+// coerceValue converts value to the type used to store attributeType
+func coerceValue(attributeType DmAttributeType, value interface{}) (interface{}, error) {
+	if value == nil && attributeType == AT_ELEMENT {
+		return (*DmElement)(nil), nil
+	}
+	if checkValue(attributeType, value) == nil {
+		return value, nil
+	}
+	if value == nil {
+		return nil, errors.New("nil value is not compatible with attribute type " + type_to_string[attributeType])
+	}
+
+	v := reflect.ValueOf(value)
+
+	if attributeType >= AT_FIRST_ARRAY_TYPE {
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return nil, fmt.Errorf("value of type %T is not compatible with attribute type %s", value, type_to_string[attributeType])
+		}
+
+		itemType := arrayItemType(attributeType)
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			item, err := coerceValue(itemType, v.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			if itemType == AT_ELEMENT && item.(*DmElement) == nil {
+				return nil, errors.New("element arrays can't contain nil elements")
+			}
+			items[i] = item
+		}
+		return makeArray(attributeType, items)
+	}
+
+	if t, ok := value.(DmTime); ok {
+		// Times are converted to numbers in seconds, like numbers are converted to times
+		v = reflect.ValueOf(t.Seconds())
+	}
+
+	switch attributeType {
+	case AT_INT:
+		i, err := coerceInt(v, math.MinInt32, math.MaxInt32)
+		return int32(i), err
+	case AT_FLOAT:
+		f, err := coerceFloat(v)
+		return float32(f), err
+	case AT_TIME:
+		// Durations are converted to ticks, numbers are seconds
+		if d, ok := value.(time.Duration); ok {
+			return DmTimeFromDuration(d), nil
+		}
+		f, err := coerceFloat(v)
+		return DmTimeFromSeconds(f), err
+	case AT_BOOL:
+		if v.Kind() == reflect.Bool {
+			return v.Bool(), nil
+		}
+	case AT_STRING:
+		if v.Kind() == reflect.String {
+			return v.String(), nil
+		}
+	case AT_VOID:
+		if v.Kind() == reflect.String {
+			return []byte(v.String()), nil
+		}
+		b := make([]byte, 0)
+		if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+			b = make([]byte, v.Len())
+		}
+		if err := coerceItems(v, len(b), func(i int, item reflect.Value) error {
+			n, err := coerceInt(item, 0, math.MaxUint8)
+			b[i] = byte(n)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		return b, nil
+	case AT_COLOR:
+		if c, ok := value.(color.Color); ok {
+			return ColorFromColor(c), nil
+		}
+		var c Color
+		if err := coerceItems(v, len(c), func(i int, item reflect.Value) error {
+			b, err := coerceInt(item, 0, math.MaxUint8)
+			c[i] = byte(b)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		return c, nil
+	case AT_VECTOR2:
+		var vec vector.Vector2[float32]
+		err := coerceFloats(v, vec[:])
+		return vec, err
+	case AT_VECTOR3, AT_QANGLE:
+		var vec vector.Vector3[float32]
+		err := coerceFloats(v, vec[:])
+		return vec, err
+	case AT_VECTOR4:
+		var vec vector.Vector4[float32]
+		err := coerceFloats(v, vec[:])
+		return vec, err
+	case AT_QUATERNION:
+		var q vector.Quaternion[float32]
+		err := coerceFloats(v, q[:])
+		return q, err
+	case AT_VMATRIX:
+		var m [16]float32
+		err := coerceFloats(v, m[:])
+		return m, err
+	case AT_UINT64:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if v.Int() >= 0 {
+				return uint64(v.Int()), nil
+			}
+			return nil, fmt.Errorf("value %d is out of range", v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return v.Uint(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("value of type %T is not compatible with attribute type %s", value, type_to_string[attributeType])
+}
+
+func coerceInt(v reflect.Value, min int64, max int64) (int64, error) {
+	var i int64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i = v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return 0, fmt.Errorf("value %d is out of range", v.Uint())
+		}
+		i = int64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if f != math.Trunc(f) || f < math.MinInt64 || f > math.MaxInt64 {
+			return 0, fmt.Errorf("value %g is not an integer", f)
+		}
+		i = int64(f)
+	default:
+		return 0, fmt.Errorf("value of type %s is not a number", v.Type())
+	}
+
+	if i < min || i > max {
+		return 0, fmt.Errorf("value %d is out of range", i)
+	}
+	return i, nil
+}
+
+func coerceFloat(v reflect.Value) (float64, error) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	default:
+		return 0, fmt.Errorf("value of type %s is not a number", v.Type())
+	}
+}
+
+func coerceFloats(v reflect.Value, dest []float32) error {
+	return coerceItems(v, len(dest), func(i int, item reflect.Value) error {
+		f, err := coerceFloat(item)
+		dest[i] = float32(f)
+		return err
+	})
+}
+
+func coerceItems(v reflect.Value, count int, f func(int, reflect.Value) error) error {
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return fmt.Errorf("value of type %s is not an array", v.Type())
+	}
+	if v.Len() != count {
+		return fmt.Errorf("expecting %d values, got %d", count, v.Len())
+	}
+
+	for i := 0; i < count; i++ {
+		item := v.Index(i)
+		if item.Kind() == reflect.Interface {
+			item = item.Elem()
+		}
+		if err := f(i, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertValue converts the value of an attribute of type from to the attribute type to
+func convertValue(from DmAttributeType, to DmAttributeType, value interface{}) (interface{}, error) {
+	if from == AT_UNKNOWN || from >= AT_TYPE_COUNT || to == AT_UNKNOWN || to >= AT_TYPE_COUNT || type_to_string[to] == "" {
+		return nil, errors.New("unsupported attribute type")
+	}
+
+	// Types sharing the same storage, like vector3 and qangle
+	if checkValue(to, value) == nil {
+		return value, nil
+	}
+
+	fromIsArray := from >= AT_FIRST_ARRAY_TYPE
+	toIsArray := to >= AT_FIRST_ARRAY_TYPE
+
+	switch {
+	case to == AT_STRING && !fromIsArray && from != AT_ELEMENT:
+		return (&DmAttribute{attributeType: from, value: value}).StringValue(), nil
+	case from == AT_STRING && !toIsArray && to != AT_ELEMENT:
+		return parseValueText(to, value.(string))
+	case toIsArray && !fromIsArray:
+		if from == AT_ELEMENT && value.(*DmElement) == nil {
+			return makeArray(to, []interface{}{})
+		}
+		item, err := convertValue(from, arrayItemType(to), value)
+		if err != nil {
+			return nil, err
+		}
+		return makeArray(to, []interface{}{item})
+	case fromIsArray && !toIsArray:
+		return nil, errors.New("can't convert an array to a single value")
+	}
+
+	return coerceValue(to, value)
+}
@@ -110,3 +110,20 @@ var type_to_string = [...]string{
 	"matrix_array",
 	"uint64_array",
 }
+
+func typeFromString(s string) DmAttributeType {
+	if s == "" {
+		return AT_UNKNOWN
+	}
+	for k, v := range type_to_string {
+		if v == s {
+			return DmAttributeType(k)
+		}
+	}
+	return AT_UNKNOWN
+}
+
+// arrayItemType returns the type of the items of an array type
+func arrayItemType(attributeType DmAttributeType) DmAttributeType {
+	return attributeType - AT_FIRST_ARRAY_TYPE + AT_FIRST_VALUE_TYPE
+}
@@ -0,0 +1,113 @@
+package dmx
+
+import (
+	"slices"
+
+	"github.com/baldurstod/go-vector"
+)
+
+type CloneOptions struct {
+	PreserveIds bool // Keep the ids of the original elements instead of creating new ones
+}
+
+type cloneContext struct {
+	options CloneOptions
+	clones  map[*DmElement]*DmElement
+	ids     map[DmObjectId]DmObjectId
+}
+
+// Clone deep copies the subgraph reachable from root. Shared elements and cycles are preserved in the copy.
+// It returns the copy of root and the mapping from the original ids to the ids of the copies.
+func Clone(root *DmElement, options CloneOptions) (*DmElement, map[DmObjectId]DmObjectId) {
+	context := &cloneContext{
+		options: options,
+		clones:  make(map[*DmElement]*DmElement),
+		ids:     make(map[DmObjectId]DmObjectId),
+	}
+
+	return cloneElement(context, root), context.ids
+}
+
+func cloneElement(context *cloneContext, element *DmElement) *DmElement {
+	if element == nil {
+		return nil
+	}
+	if clone, exist := context.clones[element]; exist {
+		return clone
+	}
+
+	var clone *DmElement
+	if context.options.PreserveIds {
+		clone = newDmElementWithId(element.Name, element.elementType, element.id)
+	} else {
+		clone = NewDmElement(element.Name, element.elementType)
+	}
+	context.clones[element] = clone
+	context.ids[element.id] = clone.id
+
+	for _, attribute := range element.orderedAttributes {
+		a := clone.CreateAttribute(attribute.name, attribute.attributeType)
+
+		switch attribute.attributeType {
+		case AT_ELEMENT:
+			if child, ok := attribute.value.(*DmElement); ok {
+				a.value = cloneElement(context, child)
+			}
+		case AT_ELEMENT_ARRAY:
+			if children, ok := attribute.value.([]*DmElement); ok {
+				clones := make([]*DmElement, len(children))
+				for k, child := range children {
+					clones[k] = cloneElement(context, child)
+				}
+				a.value = clones
+			}
+		default:
+			a.value = copyValue(attribute.value)
+		}
+	}
+
+	return clone
+}
+
+// copyValue returns a copy of an attribute value that doesn't share memory with value
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []*DmElement:
+		return slices.Clone(v)
+	case []int32:
+		return slices.Clone(v)
+	case []float32:
+		return slices.Clone(v)
+	case []DmTime:
+		return slices.Clone(v)
+	case []bool:
+		return slices.Clone(v)
+	case []string:
+		return slices.Clone(v)
+	case []byte:
+		return slices.Clone(v)
+	case [][]byte:
+		a := make([][]byte, len(v))
+		for k, b := range v {
+			a[k] = slices.Clone(b)
+		}
+		return a
+	case []Color:
+		return slices.Clone(v)
+	case []vector.Vector2[float32]:
+		return slices.Clone(v)
+	case []vector.Vector3[float32]:
+		return slices.Clone(v)
+	case []vector.Vector4[float32]:
+		return slices.Clone(v)
+	case []vector.Quaternion[float32]:
+		return slices.Clone(v)
+	case [][16]float32:
+		return slices.Clone(v)
+	case []uint64:
+		return slices.Clone(v)
+	default:
+		// Other values are not references
+		return value
+	}
+}
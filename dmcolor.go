@@ -0,0 +1,167 @@
+package dmx
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/baldurstod/go-vector"
+)
+
+// Color is the value of color attributes, 8 bits sRGB components with a non premultiplied alpha.
+// It implements color.Color.
+//
+// Color values were stored as [4]byte before: setters still accept [4]byte and Get[[4]byte] still works,
+// but GetValue returns a Color and a type assertion to [4]byte fails.
+type Color [4]byte
+
+func NewColor(r uint8, g uint8, b uint8, a uint8) Color {
+	return Color{r, g, b, a}
+}
+
+func (c Color) R() uint8 {
+	return c[0]
+}
+
+func (c Color) G() uint8 {
+	return c[1]
+}
+
+func (c Color) B() uint8 {
+	return c[2]
+}
+
+func (c Color) A() uint8 {
+	return c[3]
+}
+
+// RGBA implements color.Color, it returns alpha premultiplied components
+func (c Color) RGBA() (r, g, b, a uint32) {
+	return c.NRGBA().RGBA()
+}
+
+func (c Color) NRGBA() color.NRGBA {
+	return color.NRGBA{R: c[0], G: c[1], B: c[2], A: c[3]}
+}
+
+// PremultipliedRGBA returns the color with its components multiplied by alpha
+func (c Color) PremultipliedRGBA() color.RGBA {
+	return color.RGBAModel.Convert(c.NRGBA()).(color.RGBA)
+}
+
+// ColorFromColor converts any color, like color.RGBA or color.NRGBA
+func ColorFromColor(c color.Color) Color {
+	if dc, ok := c.(Color); ok {
+		return dc
+	}
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return Color{n.R, n.G, n.B, n.A}
+}
+
+// Floats returns the sRGB components in the range [0, 1]
+func (c Color) Floats() vector.Vector4[float32] {
+	return vector.Vector4[float32]{float32(c[0]) / 255, float32(c[1]) / 255, float32(c[2]) / 255, float32(c[3]) / 255}
+}
+
+// LinearFloats returns the linear components in the range [0, 1], alpha is unchanged
+func (c Color) LinearFloats() vector.Vector4[float32] {
+	f := c.Floats()
+	return vector.Vector4[float32]{srgbToLinear(f[0]), srgbToLinear(f[1]), srgbToLinear(f[2]), f[3]}
+}
+
+// ColorFromFloats returns the nearest color to sRGB components in the range [0, 1], out of range components are clamped
+func ColorFromFloats(f vector.Vector4[float32]) Color {
+	return Color{floatToByte(f[0]), floatToByte(f[1]), floatToByte(f[2]), floatToByte(f[3])}
+}
+
+// ColorFromLinearFloats returns the nearest color to linear components in the range [0, 1], alpha is not converted
+func ColorFromLinearFloats(f vector.Vector4[float32]) Color {
+	return ColorFromFloats(vector.Vector4[float32]{linearToSrgb(f[0]), linearToSrgb(f[1]), linearToSrgb(f[2]), f[3]})
+}
+
+func floatToByte(f float32) byte {
+	return byte(math.Round(float64(min(max(f, 0), 1)) * 255))
+}
+
+func srgbToLinear(f float32) float32 {
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return float32(math.Pow((float64(f)+0.055)/1.055, 2.4))
+}
+
+func linearToSrgb(f float32) float32 {
+	if f <= 0.0031308 {
+		return f * 12.92
+	}
+	return float32(1.055*math.Pow(float64(f), 1/2.4) - 0.055)
+}
+
+// Hex returns the color as #rrggbbaa
+func (c Color) Hex() string {
+	return "#" + hex.EncodeToString(c[:])
+}
+
+// ParseColor parses a hex color: #rgb, #rgba, #rrggbb or #rrggbbaa, the # is optional and alpha defaults to 255
+func ParseColor(s string) (Color, error) {
+	h := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(h) == 3 || len(h) == 4 {
+		// Short form, each digit is repeated
+		var sb strings.Builder
+		for _, d := range h {
+			sb.WriteRune(d)
+			sb.WriteRune(d)
+		}
+		h = sb.String()
+	}
+	if len(h) == 6 {
+		h += "ff"
+	}
+
+	var c Color
+	if len(h) != 8 {
+		return c, errors.New("invalid color " + s)
+	}
+	if _, err := hex.Decode(c[:], []byte(h)); err != nil {
+		return c, fmt.Errorf("invalid color %s: %w", s, err)
+	}
+	return c, nil
+}
+
+// normalizeValue converts the legacy representations of a value to the type used to store attributeType,
+// [4]byte colors are converted to Color
+func normalizeValue(attributeType DmAttributeType, value interface{}) interface{} {
+	switch v := value.(type) {
+	case [4]byte:
+		if attributeType == AT_COLOR {
+			return Color(v)
+		}
+	case [][4]byte:
+		if attributeType == AT_COLOR_ARRAY {
+			a := make([]Color, len(v))
+			for k, c := range v {
+				a[k] = c
+			}
+			return a
+		}
+	}
+	return value
+}
+
+// legacyValue converts value to its legacy representation, Color to [4]byte
+func legacyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case Color:
+		return [4]byte(v)
+	case []Color:
+		a := make([][4]byte, len(v))
+		for k, c := range v {
+			a[k] = c
+		}
+		return a
+	}
+	return value
+}
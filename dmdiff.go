@@ -0,0 +1,316 @@
+package dmx
+
+import (
+	"bytes"
+	"math"
+	"slices"
+	"strconv"
+
+	"github.com/baldurstod/go-vector"
+)
+
+type CompareOptions struct {
+	FloatTolerance float64 // Maximum absolute difference between two float components, applies to float, time (in seconds), vector, qangle, quaternion and matrix types
+	CompareIds     bool    // Equal also compares element ids
+}
+
+// Equal returns true if the graphs reachable from a and b have the same structure, element names, types and attribute values.
+// Attribute order is not significant.
+func Equal(a *DmElement, b *DmElement, options CompareOptions) bool {
+	pairs := make(map[*DmElement]*DmElement)
+	reversePairs := make(map[*DmElement]*DmElement)
+
+	var elementsEqual func(x *DmElement, y *DmElement) bool
+	elementsEqual = func(x *DmElement, y *DmElement) bool {
+		if x == nil || y == nil {
+			return x == y
+		}
+		if p, exist := pairs[x]; exist {
+			return p == y
+		}
+		if _, exist := reversePairs[y]; exist {
+			return false
+		}
+		pairs[x] = y
+		reversePairs[y] = x
+
+		if x.Name != y.Name || x.elementType != y.elementType || len(x.orderedAttributes) != len(y.orderedAttributes) {
+			return false
+		}
+		if options.CompareIds && x.id != y.id {
+			return false
+		}
+
+		for _, xa := range x.orderedAttributes {
+			ya, exist := y.attributes[xa.name]
+			if !exist || xa.attributeType != ya.attributeType {
+				return false
+			}
+			if !valuesEqual(xa.value, ya.value, options.FloatTolerance, elementsEqual) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return elementsEqual(a, b)
+}
+
+type DiffKind int
+
+const (
+	DIFF_ELEMENT_ADDED DiffKind = iota
+	DIFF_ELEMENT_REMOVED
+	DIFF_ELEMENT_RENAMED
+	DIFF_ELEMENT_TYPE_CHANGED
+	DIFF_ATTRIBUTE_ADDED
+	DIFF_ATTRIBUTE_REMOVED
+	DIFF_ATTRIBUTE_CHANGED
+)
+
+var diffKindToString = [...]string{
+	"element added",
+	"element removed",
+	"element renamed",
+	"element type changed",
+	"attribute added",
+	"attribute removed",
+	"attribute changed",
+}
+
+func (kind DiffKind) String() string {
+	if kind < 0 || int(kind) >= len(diffKindToString) {
+		return "unknown"
+	}
+	return diffKindToString[kind]
+}
+
+type Difference struct {
+	Kind      DiffKind
+	Path      string     // Path of the element, in the old graph for removed elements and in the new graph otherwise
+	Old       *DmElement // nil for added elements
+	New       *DmElement // nil for removed elements
+	Attribute string     // Name of the attribute for attribute differences
+	OldType   DmAttributeType
+	NewType   DmAttributeType
+	OldValue  interface{} // Old value of the attribute, or old name / type for renamed elements and changed types
+	NewValue  interface{}
+}
+
+type diffGraph struct {
+	elements []*DmElement
+	paths    map[*DmElement]string
+}
+
+func newDiffGraph(root *DmElement) *diffGraph {
+	graph := &diffGraph{
+		elements: make([]*DmElement, 0, 64),
+		paths:    make(map[*DmElement]string),
+	}
+	graph.add(root, "root")
+	return graph
+}
+
+func (graph *diffGraph) add(element *DmElement, path string) {
+	if element == nil {
+		return
+	}
+	if _, exist := graph.paths[element]; exist {
+		return
+	}
+	graph.paths[element] = path
+	graph.elements = append(graph.elements, element)
+
+	for _, a := range element.orderedAttributes {
+		switch a.attributeType {
+		case AT_ELEMENT:
+			if child, ok := a.value.(*DmElement); ok {
+				graph.add(child, path+"."+a.name)
+			}
+		case AT_ELEMENT_ARRAY:
+			if children, ok := a.value.([]*DmElement); ok {
+				for k, child := range children {
+					graph.add(child, path+"."+a.name+"["+strconv.Itoa(k)+"]")
+				}
+			}
+		}
+	}
+}
+
+// Diff returns the differences between the graph reachable from oldRoot and the one reachable from newRoot.
+// Elements are matched by id, elements whose id doesn't match are matched by path.
+func Diff(oldRoot *DmElement, newRoot *DmElement, options CompareOptions) []Difference {
+	oldGraph := newDiffGraph(oldRoot)
+	newGraph := newDiffGraph(newRoot)
+
+	matches := make(map[*DmElement]*DmElement)
+	matched := make(map[*DmElement]struct{})
+
+	ids := make(map[DmObjectId]*DmElement)
+	paths := make(map[string]*DmElement)
+	for _, e := range newGraph.elements {
+		ids[e.id] = e
+		paths[newGraph.paths[e]] = e
+	}
+
+	match := func(oldElement *DmElement, newElement *DmElement) {
+		if newElement == nil {
+			return
+		}
+		if _, exist := matched[newElement]; exist {
+			return
+		}
+		matches[oldElement] = newElement
+		matched[newElement] = struct{}{}
+	}
+
+	for _, e := range oldGraph.elements {
+		match(e, ids[e.id])
+	}
+	for _, e := range oldGraph.elements {
+		if _, exist := matches[e]; !exist {
+			match(e, paths[oldGraph.paths[e]])
+		}
+	}
+
+	elementsEqual := func(x *DmElement, y *DmElement) bool {
+		if x == nil || y == nil {
+			return x == y
+		}
+		return matches[x] == y
+	}
+
+	differences := make([]Difference, 0)
+	for _, oldElement := range oldGraph.elements {
+		newElement, exist := matches[oldElement]
+		if !exist {
+			differences = append(differences, Difference{Kind: DIFF_ELEMENT_REMOVED, Path: oldGraph.paths[oldElement], Old: oldElement})
+			continue
+		}
+
+		path := newGraph.paths[newElement]
+		if oldElement.Name != newElement.Name {
+			differences = append(differences, Difference{Kind: DIFF_ELEMENT_RENAMED, Path: path, Old: oldElement, New: newElement, OldValue: oldElement.Name, NewValue: newElement.Name})
+		}
+		if oldElement.elementType != newElement.elementType {
+			differences = append(differences, Difference{Kind: DIFF_ELEMENT_TYPE_CHANGED, Path: path, Old: oldElement, New: newElement, OldValue: oldElement.elementType, NewValue: newElement.elementType})
+		}
+
+		for _, oldAttribute := range oldElement.orderedAttributes {
+			newAttribute, exist := newElement.attributes[oldAttribute.name]
+			if !exist {
+				differences = append(differences, Difference{Kind: DIFF_ATTRIBUTE_REMOVED, Path: path, Old: oldElement, New: newElement, Attribute: oldAttribute.name, OldType: oldAttribute.attributeType, OldValue: oldAttribute.value})
+				continue
+			}
+			if oldAttribute.attributeType != newAttribute.attributeType || !valuesEqual(oldAttribute.value, newAttribute.value, options.FloatTolerance, elementsEqual) {
+				differences = append(differences, Difference{Kind: DIFF_ATTRIBUTE_CHANGED, Path: path, Old: oldElement, New: newElement, Attribute: oldAttribute.name, OldType: oldAttribute.attributeType, NewType: newAttribute.attributeType, OldValue: oldAttribute.value, NewValue: newAttribute.value})
+			}
+		}
+
+		for _, newAttribute := range newElement.orderedAttributes {
+			if _, exist := oldElement.attributes[newAttribute.name]; !exist {
+				differences = append(differences, Difference{Kind: DIFF_ATTRIBUTE_ADDED, Path: path, Old: oldElement, New: newElement, Attribute: newAttribute.name, NewType: newAttribute.attributeType, NewValue: newAttribute.value})
+			}
+		}
+	}
+
+	for _, newElement := range newGraph.elements {
+		if _, exist := matched[newElement]; !exist {
+			differences = append(differences, Difference{Kind: DIFF_ELEMENT_ADDED, Path: newGraph.paths[newElement], New: newElement})
+		}
+	}
+
+	return differences
+}
+
+// valuesEqual compares two attribute values, elements are compared with elementsEqual
+func valuesEqual(a interface{}, b interface{}, tolerance float64, elementsEqual func(*DmElement, *DmElement) bool) bool {
+	switch va := a.(type) {
+	case *DmElement:
+		vb, ok := b.(*DmElement)
+		return ok && elementsEqual(va, vb)
+	case float32:
+		vb, ok := b.(float32)
+		return ok && floatEqual(va, vb, tolerance)
+	case DmTime:
+		vb, ok := b.(DmTime)
+		return ok && timeEqual(va, vb, tolerance)
+	case vector.Vector2[float32]:
+		vb, ok := b.(vector.Vector2[float32])
+		return ok && floatsEqual(va[:], vb[:], tolerance)
+	case vector.Vector3[float32]:
+		vb, ok := b.(vector.Vector3[float32])
+		return ok && floatsEqual(va[:], vb[:], tolerance)
+	case vector.Vector4[float32]:
+		vb, ok := b.(vector.Vector4[float32])
+		return ok && floatsEqual(va[:], vb[:], tolerance)
+	case vector.Quaternion[float32]:
+		vb, ok := b.(vector.Quaternion[float32])
+		return ok && floatsEqual(va[:], vb[:], tolerance)
+	case [16]float32:
+		vb, ok := b.([16]float32)
+		return ok && floatsEqual(va[:], vb[:], tolerance)
+	case []*DmElement:
+		vb, ok := b.([]*DmElement)
+		return ok && slices.EqualFunc(va, vb, elementsEqual)
+	case []int32:
+		vb, ok := b.([]int32)
+		return ok && slices.Equal(va, vb)
+	case []float32:
+		vb, ok := b.([]float32)
+		return ok && floatsEqual(va, vb, tolerance)
+	case []DmTime:
+		vb, ok := b.([]DmTime)
+		return ok && slices.EqualFunc(va, vb, func(x, y DmTime) bool { return timeEqual(x, y, tolerance) })
+	case []bool:
+		vb, ok := b.([]bool)
+		return ok && slices.Equal(va, vb)
+	case []string:
+		vb, ok := b.([]string)
+		return ok && slices.Equal(va, vb)
+	case []byte:
+		vb, ok := b.([]byte)
+		return ok && bytes.Equal(va, vb)
+	case [][]byte:
+		vb, ok := b.([][]byte)
+		return ok && slices.EqualFunc(va, vb, bytes.Equal)
+	case []Color:
+		vb, ok := b.([]Color)
+		return ok && slices.Equal(va, vb)
+	case []vector.Vector2[float32]:
+		vb, ok := b.([]vector.Vector2[float32])
+		return ok && slices.EqualFunc(va, vb, func(x, y vector.Vector2[float32]) bool { return floatsEqual(x[:], y[:], tolerance) })
+	case []vector.Vector3[float32]:
+		vb, ok := b.([]vector.Vector3[float32])
+		return ok && slices.EqualFunc(va, vb, func(x, y vector.Vector3[float32]) bool { return floatsEqual(x[:], y[:], tolerance) })
+	case []vector.Vector4[float32]:
+		vb, ok := b.([]vector.Vector4[float32])
+		return ok && slices.EqualFunc(va, vb, func(x, y vector.Vector4[float32]) bool { return floatsEqual(x[:], y[:], tolerance) })
+	case []vector.Quaternion[float32]:
+		vb, ok := b.([]vector.Quaternion[float32])
+		return ok && slices.EqualFunc(va, vb, func(x, y vector.Quaternion[float32]) bool { return floatsEqual(x[:], y[:], tolerance) })
+	case [][16]float32:
+		vb, ok := b.([][16]float32)
+		return ok && slices.EqualFunc(va, vb, func(x, y [16]float32) bool { return floatsEqual(x[:], y[:], tolerance) })
+	case []uint64:
+		vb, ok := b.([]uint64)
+		return ok && slices.Equal(va, vb)
+	case int32, bool, string, Color, uint64:
+		return a == b
+	default:
+		return false
+	}
+}
+
+func floatEqual(a float32, b float32, tolerance float64) bool {
+	return a == b || math.Abs(float64(a)-float64(b)) <= tolerance
+}
+
+// timeEqual compares times with a tolerance in seconds
+func timeEqual(a DmTime, b DmTime, tolerance float64) bool {
+	return a == b || math.Abs(a.Seconds()-b.Seconds()) <= tolerance
+}
+
+func floatsEqual(a []float32, b []float32, tolerance float64) bool {
+	return slices.EqualFunc(a, b, func(x, y float32) bool { return floatEqual(x, y, tolerance) })
+}
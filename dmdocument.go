@@ -0,0 +1,87 @@
+package dmx
+
+import (
+	"errors"
+	"slices"
+)
+
+// Type of the element holding the prefix attributes in keyvalues2 files
+const PREFIX_ELEMENT_TYPE = "$prefix_element$"
+
+// DmDocument is the content of a dmx file: the header, the root, the prefix attributes
+// and the elements owned by the file, including the ones that are not reachable from the root.
+type DmDocument struct {
+	Header   DmHeader
+	Root     *DmElement
+	prefix   *DmElement
+	elements []*DmElement // elements loaded with the document or added with AddElement
+}
+
+func NewDmDocument(root *DmElement, header DmHeader) *DmDocument {
+	return &DmDocument{
+		Header:   header,
+		Root:     root,
+		elements: make([]*DmElement, 0),
+	}
+}
+
+// GetPrefix returns the element holding the prefix attributes, it is created if needed.
+// Prefix attributes are file metadata written before the elements, they can't reference elements.
+func (document *DmDocument) GetPrefix() *DmElement {
+	if document.prefix == nil {
+		document.prefix = newDmElementWithId("", PREFIX_ELEMENT_TYPE, NilObjectId)
+	}
+	return document.prefix
+}
+
+func (document *DmDocument) hasPrefix() bool {
+	return document.prefix != nil && len(document.prefix.orderedAttributes) > 0
+}
+
+// AddElement makes the document own element, it is written even if it isn't reachable from the root
+func (document *DmDocument) AddElement(element *DmElement) {
+	if element != nil && !slices.Contains(document.elements, element) {
+		document.elements = append(document.elements, element)
+	}
+}
+
+// Elements returns the elements reachable from the root followed by the other owned elements
+func (document *DmDocument) Elements() []*DmElement {
+	visited := make(map[*DmElement]struct{})
+	elements := make([]*DmElement, 0, len(document.elements))
+
+	add := func(root *DmElement) {
+		if _, exist := visited[root]; exist || root == nil {
+			return
+		}
+		for _, e := range DepthFirst(root) {
+			if _, exist := visited[e]; !exist {
+				visited[e] = struct{}{}
+				elements = append(elements, e)
+			}
+		}
+	}
+
+	add(document.Root)
+	for _, e := range document.elements {
+		add(e)
+	}
+	return elements
+}
+
+// RemoveUnreachable releases the owned elements that are not reachable from the root
+func (document *DmDocument) RemoveUnreachable() {
+	document.elements = make([]*DmElement, 0)
+	for _, e := range DepthFirst(document.Root) {
+		document.elements = append(document.elements, e)
+	}
+}
+
+func checkPrefix(prefix *DmElement) error {
+	for _, a := range prefix.orderedAttributes {
+		if a.attributeType == AT_ELEMENT || a.attributeType == AT_ELEMENT_ARRAY {
+			return errors.New("prefix attribute " + a.name + " can't reference elements")
+		}
+	}
+	return nil
+}
@@ -1,20 +1,32 @@
 package dmx
 
-import "github.com/baldurstod/go-vector"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/baldurstod/go-vector"
+)
 
 type DmElement struct {
-	Name        string
-	id          DmObjectId
-	elementType string
-	attributes  map[string]*DmAttribute
+	Name              string
+	id                DmObjectId
+	elementType       string
+	attributes        map[string]*DmAttribute
+	orderedAttributes []*DmAttribute // attributes in insertion order
 }
 
 func NewDmElement(name string, elementType string) *DmElement {
+	return newDmElementWithId(name, elementType, CreateObjectId())
+}
+
+// newDmElementWithId creates an element whose id is already known, without drawing one from the id source
+func newDmElementWithId(name string, elementType string, id DmObjectId) *DmElement {
 	return &DmElement{
-		Name:        name,
-		id:          CreateObjectId(),
-		elementType: elementType,
-		attributes:  map[string]*DmAttribute{},
+		Name:              name,
+		id:                id,
+		elementType:       elementType,
+		attributes:        map[string]*DmAttribute{},
+		orderedAttributes: make([]*DmAttribute, 0, 8),
 	}
 }
 
@@ -30,10 +42,82 @@ func (element *DmElement) CreateAttribute(name string, attributeType DmAttribute
 
 	attribute = newDmAttribute(name, attributeType, element)
 	element.attributes[name] = attribute
+	element.orderedAttributes = append(element.orderedAttributes, attribute)
+
+	return attribute
+}
+
+func (element *DmElement) HasAttribute(name string) bool {
+	_, exist := element.attributes[name]
+	return exist
+}
+
+// GetAttribute returns the attribute name or nil if it doesn't exist
+func (element *DmElement) GetAttribute(name string) *DmAttribute {
+	return element.attributes[name]
+}
+
+// RemoveAttribute removes the attribute name and returns it, or returns nil if it doesn't exist
+func (element *DmElement) RemoveAttribute(name string) *DmAttribute {
+	attribute, exist := element.attributes[name]
+	if !exist {
+		return nil
+	}
+
+	delete(element.attributes, name)
+	for k, a := range element.orderedAttributes {
+		if a == attribute {
+			element.orderedAttributes = append(element.orderedAttributes[:k], element.orderedAttributes[k+1:]...)
+			break
+		}
+	}
+	attribute.owner = nil
 
 	return attribute
 }
 
+// RenameAttribute renames an attribute and keeps its position
+func (element *DmElement) RenameAttribute(name string, newName string) error {
+	attribute, exist := element.attributes[name]
+	if !exist {
+		return errors.New("attribute " + name + " not found")
+	}
+	if name == newName {
+		return nil
+	}
+	if _, exist := element.attributes[newName]; exist {
+		return errors.New("attribute " + newName + " already exists")
+	}
+
+	delete(element.attributes, name)
+	element.attributes[newName] = attribute
+	attribute.name = newName
+
+	return nil
+}
+
+// ChangeAttributeType changes the type of an attribute and converts its value.
+// The attribute is left untouched if the value can't be converted.
+func (element *DmElement) ChangeAttributeType(name string, attributeType DmAttributeType) error {
+	attribute, exist := element.attributes[name]
+	if !exist {
+		return errors.New("attribute " + name + " not found")
+	}
+	if attribute.attributeType == attributeType {
+		return nil
+	}
+
+	value, err := convertValue(attribute.attributeType, attributeType, attribute.value)
+	if err != nil {
+		return fmt.Errorf("can't change type of attribute %s from %s to %s: %w", name, type_to_string[attribute.attributeType], type_to_string[attributeType], err)
+	}
+
+	attribute.attributeType = attributeType
+	attribute.value = value
+
+	return nil
+}
+
 func (element *DmElement) GetId() DmObjectId {
 	return element.id
 }
@@ -100,7 +184,17 @@ func (element *DmElement) CreateStringAttribute(name string, value string) *DmAt
 	return attribute
 }
 
-func (element *DmElement) CreateTimeAttribute(name string, value float32) *DmAttribute {
+func (element *DmElement) CreateBinaryAttribute(name string, value []byte) *DmAttribute {
+	attribute := element.CreateAttribute(name, AT_VOID)
+
+	if attribute != nil {
+		attribute.SetValue(value)
+	}
+
+	return attribute
+}
+
+func (element *DmElement) CreateTimeAttribute(name string, value DmTime) *DmAttribute {
 	attribute := element.CreateAttribute(name, AT_TIME)
 
 	if attribute != nil {
@@ -110,7 +204,7 @@ func (element *DmElement) CreateTimeAttribute(name string, value float32) *DmAtt
 	return attribute
 }
 
-func (element *DmElement) CreateColorAttribute(name string, value [4]byte) *DmAttribute {
+func (element *DmElement) CreateColorAttribute(name string, value Color) *DmAttribute {
 	attribute := element.CreateAttribute(name, AT_COLOR)
 
 	if attribute != nil {
@@ -189,3 +283,139 @@ func (element *DmElement) CreateUint64Attribute(name string, value uint64) *DmAt
 
 	return attribute
 }
+
+// getValue returns the value of the attribute name if it exists and is of type attributeType
+func getValue[T any](element *DmElement, name string, attributeType DmAttributeType) (T, error) {
+	attribute, exist := element.attributes[name]
+	if !exist {
+		var zero T
+		return zero, fmt.Errorf("attribute %s not found", name)
+	}
+	if attribute.attributeType != attributeType {
+		var zero T
+		return zero, fmt.Errorf("attribute %s is of type %s, expecting %s", name, type_to_string[attribute.attributeType], type_to_string[attributeType])
+	}
+	return Get[T](attribute)
+}
+
+func (element *DmElement) GetElement(name string) (*DmElement, error) {
+	return getValue[*DmElement](element, name, AT_ELEMENT)
+}
+
+func (element *DmElement) GetInt(name string) (int32, error) {
+	return getValue[int32](element, name, AT_INT)
+}
+
+func (element *DmElement) GetFloat(name string) (float32, error) {
+	return getValue[float32](element, name, AT_FLOAT)
+}
+
+func (element *DmElement) GetBool(name string) (bool, error) {
+	return getValue[bool](element, name, AT_BOOL)
+}
+
+func (element *DmElement) GetString(name string) (string, error) {
+	return getValue[string](element, name, AT_STRING)
+}
+
+func (element *DmElement) GetBinary(name string) ([]byte, error) {
+	return getValue[[]byte](element, name, AT_VOID)
+}
+
+func (element *DmElement) GetTime(name string) (DmTime, error) {
+	return getValue[DmTime](element, name, AT_TIME)
+}
+
+func (element *DmElement) GetColor(name string) (Color, error) {
+	return getValue[Color](element, name, AT_COLOR)
+}
+
+func (element *DmElement) GetVector2(name string) (vector.Vector2[float32], error) {
+	return getValue[vector.Vector2[float32]](element, name, AT_VECTOR2)
+}
+
+func (element *DmElement) GetVector3(name string) (vector.Vector3[float32], error) {
+	return getValue[vector.Vector3[float32]](element, name, AT_VECTOR3)
+}
+
+func (element *DmElement) GetVector4(name string) (vector.Vector4[float32], error) {
+	return getValue[vector.Vector4[float32]](element, name, AT_VECTOR4)
+}
+
+func (element *DmElement) GetQAngle(name string) (vector.Vector3[float32], error) {
+	return getValue[vector.Vector3[float32]](element, name, AT_QANGLE)
+}
+
+func (element *DmElement) GetQuaternion(name string) (vector.Quaternion[float32], error) {
+	return getValue[vector.Quaternion[float32]](element, name, AT_QUATERNION)
+}
+
+func (element *DmElement) GetMatrix(name string) ([16]float32, error) {
+	return getValue[[16]float32](element, name, AT_VMATRIX)
+}
+
+func (element *DmElement) GetUint64(name string) (uint64, error) {
+	return getValue[uint64](element, name, AT_UINT64)
+}
+
+// GetElementArray returns the elements of an element array attribute.
+// Arrays loaded from a file keep their null entries as nil elements, the setters don't accept them.
+func (element *DmElement) GetElementArray(name string) ([]*DmElement, error) {
+	return getValue[[]*DmElement](element, name, AT_ELEMENT_ARRAY)
+}
+
+func (element *DmElement) GetIntArray(name string) ([]int32, error) {
+	return getValue[[]int32](element, name, AT_INT_ARRAY)
+}
+
+func (element *DmElement) GetFloatArray(name string) ([]float32, error) {
+	return getValue[[]float32](element, name, AT_FLOAT_ARRAY)
+}
+
+func (element *DmElement) GetBoolArray(name string) ([]bool, error) {
+	return getValue[[]bool](element, name, AT_BOOL_ARRAY)
+}
+
+func (element *DmElement) GetStringArray(name string) ([]string, error) {
+	return getValue[[]string](element, name, AT_STRING_ARRAY)
+}
+
+func (element *DmElement) GetBinaryArray(name string) ([][]byte, error) {
+	return getValue[[][]byte](element, name, AT_VOID_ARRAY)
+}
+
+func (element *DmElement) GetTimeArray(name string) ([]DmTime, error) {
+	return getValue[[]DmTime](element, name, AT_TIME_ARRAY)
+}
+
+func (element *DmElement) GetColorArray(name string) ([]Color, error) {
+	return getValue[[]Color](element, name, AT_COLOR_ARRAY)
+}
+
+func (element *DmElement) GetVector2Array(name string) ([]vector.Vector2[float32], error) {
+	return getValue[[]vector.Vector2[float32]](element, name, AT_VECTOR2_ARRAY)
+}
+
+func (element *DmElement) GetVector3Array(name string) ([]vector.Vector3[float32], error) {
+	return getValue[[]vector.Vector3[float32]](element, name, AT_VECTOR3_ARRAY)
+}
+
+func (element *DmElement) GetVector4Array(name string) ([]vector.Vector4[float32], error) {
+	return getValue[[]vector.Vector4[float32]](element, name, AT_VECTOR4_ARRAY)
+}
+
+func (element *DmElement) GetQAngleArray(name string) ([]vector.Vector3[float32], error) {
+	return getValue[[]vector.Vector3[float32]](element, name, AT_QANGLE_ARRAY)
+}
+
+func (element *DmElement) GetQuaternionArray(name string) ([]vector.Quaternion[float32], error) {
+	return getValue[[]vector.Quaternion[float32]](element, name, AT_QUATERNION_ARRAY)
+}
+
+func (element *DmElement) GetMatrixArray(name string) ([][16]float32, error) {
+	return getValue[[][16]float32](element, name, AT_VMATRIX_ARRAY)
+}
+
+func (element *DmElement) GetUint64Array(name string) ([]uint64, error) {
+	return getValue[[]uint64](element, name, AT_UINT64_ARRAY)
+}
@@ -0,0 +1,215 @@
+package dmx
+
+import (
+	"iter"
+	"slices"
+)
+
+// DmIndex indexes the elements reachable from a root by id, name and type,
+// and the attributes referencing each element.
+// Elements modified after being indexed must be passed to Update.
+type DmIndex struct {
+	root       *DmElement
+	entries    map[*DmElement]*indexEntry
+	ids        map[DmObjectId][]*DmElement // several elements may share an id, in indexing order
+	names      map[string][]*DmElement
+	types      map[string][]*DmElement
+	references map[*DmElement][]*DmAttribute
+}
+
+// indexEntry records what an element was indexed with, to be able to unindex it
+type indexEntry struct {
+	id          DmObjectId
+	name        string
+	elementType string
+	references  []indexReference
+}
+
+// indexReference is a reference from an attribute of the indexed element to child
+type indexReference struct {
+	child     *DmElement
+	attribute *DmAttribute
+}
+
+func NewDmIndex(root *DmElement) *DmIndex {
+	index := &DmIndex{}
+	index.SetRoot(root)
+	return index
+}
+
+func (index *DmIndex) GetRoot() *DmElement {
+	return index.root
+}
+
+// SetRoot clears the index and indexes the elements reachable from root
+func (index *DmIndex) SetRoot(root *DmElement) {
+	index.root = root
+	index.entries = make(map[*DmElement]*indexEntry)
+	index.ids = make(map[DmObjectId][]*DmElement)
+	index.names = make(map[string][]*DmElement)
+	index.types = make(map[string][]*DmElement)
+	index.references = make(map[*DmElement][]*DmAttribute)
+	index.Add(root)
+}
+
+// Rebuild reindexes the elements reachable from the root
+func (index *DmIndex) Rebuild() {
+	index.SetRoot(index.root)
+}
+
+// Add indexes the elements reachable from element that are not already indexed
+func (index *DmIndex) Add(element *DmElement) {
+	for _, e := range DepthFirst(element) {
+		if _, exist := index.entries[e]; !exist {
+			index.add(e)
+		}
+	}
+}
+
+// Update reindexes element after its id, name, type or attributes have changed.
+// The elements it now references are indexed too.
+func (index *DmIndex) Update(element *DmElement) {
+	if element == nil {
+		return
+	}
+	index.remove(element)
+	index.Add(element)
+}
+
+// Remove unindexes element, the elements it references stay indexed
+func (index *DmIndex) Remove(element *DmElement) {
+	if element == nil {
+		return
+	}
+	index.remove(element)
+}
+
+func (index *DmIndex) add(element *DmElement) {
+	entry := &indexEntry{
+		id:          element.id,
+		name:        element.Name,
+		elementType: element.elementType,
+		references:  make([]indexReference, 0),
+	}
+	index.entries[element] = entry
+
+	index.ids[element.id] = append(index.ids[element.id], element)
+	index.names[element.Name] = append(index.names[element.Name], element)
+	index.types[element.elementType] = append(index.types[element.elementType], element)
+
+	for _, attribute := range element.orderedAttributes {
+		// An element array may reference the same child several times
+		var seen map[*DmElement]struct{}
+		if attribute.attributeType == AT_ELEMENT_ARRAY {
+			seen = make(map[*DmElement]struct{})
+		}
+		for child := range attributeChildren(attribute) {
+			if seen != nil {
+				if _, exist := seen[child]; exist {
+					continue
+				}
+				seen[child] = struct{}{}
+			}
+			index.references[child] = append(index.references[child], attribute)
+			entry.references = append(entry.references, indexReference{child: child, attribute: attribute})
+		}
+	}
+}
+
+func (index *DmIndex) remove(element *DmElement) {
+	entry, exist := index.entries[element]
+	if !exist {
+		return
+	}
+	delete(index.entries, element)
+
+	index.ids[entry.id] = removeElement(index.ids[entry.id], element)
+	if len(index.ids[entry.id]) == 0 {
+		delete(index.ids, entry.id)
+	}
+	index.names[entry.name] = removeElement(index.names[entry.name], element)
+	if len(index.names[entry.name]) == 0 {
+		delete(index.names, entry.name)
+	}
+	index.types[entry.elementType] = removeElement(index.types[entry.elementType], element)
+	if len(index.types[entry.elementType]) == 0 {
+		delete(index.types, entry.elementType)
+	}
+
+	// Only remove the references recorded for element, its attributes may have been detached since
+	for _, ref := range entry.references {
+		index.references[ref.child] = slices.DeleteFunc(index.references[ref.child], func(a *DmAttribute) bool {
+			return a == ref.attribute
+		})
+		if len(index.references[ref.child]) == 0 {
+			delete(index.references, ref.child)
+		}
+	}
+}
+
+func removeElement(elements []*DmElement, element *DmElement) []*DmElement {
+	return slices.DeleteFunc(elements, func(e *DmElement) bool { return e == element })
+}
+
+// attributeChildren returns the non nil elements referenced by an attribute
+func attributeChildren(attribute *DmAttribute) iter.Seq[*DmElement] {
+	return func(yield func(*DmElement) bool) {
+		switch attribute.attributeType {
+		case AT_ELEMENT:
+			if e, ok := attribute.value.(*DmElement); ok && e != nil {
+				yield(e)
+			}
+		case AT_ELEMENT_ARRAY:
+			if v, ok := attribute.value.([]*DmElement); ok {
+				for _, e := range v {
+					if e != nil && !yield(e) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// Contains returns true if the element is indexed
+func (index *DmIndex) Contains(element *DmElement) bool {
+	_, exist := index.entries[element]
+	return exist
+}
+
+// Len returns the number of indexed elements
+func (index *DmIndex) Len() int {
+	return len(index.entries)
+}
+
+// FindById returns the first indexed element with the given id or nil
+func (index *DmIndex) FindById(id DmObjectId) *DmElement {
+	if elements := index.ids[id]; len(elements) > 0 {
+		return elements[0]
+	}
+	return nil
+}
+
+// FindByName returns the first indexed element with the given name or nil
+func (index *DmIndex) FindByName(name string) *DmElement {
+	if elements := index.names[name]; len(elements) > 0 {
+		return elements[0]
+	}
+	return nil
+}
+
+// FindAllByName returns the elements with the given name in indexing order
+func (index *DmIndex) FindAllByName(name string) []*DmElement {
+	return slices.Clone(index.names[name])
+}
+
+// FindAllByType returns the elements of the given type in indexing order
+func (index *DmIndex) FindAllByType(elementType string) []*DmElement {
+	return slices.Clone(index.types[elementType])
+}
+
+// ReferencesTo returns the element and element array attributes referencing element.
+// Use GetOwner to get the referencing elements.
+func (index *DmIndex) ReferencesTo(element *DmElement) []*DmAttribute {
+	return slices.Clone(index.references[element])
+}
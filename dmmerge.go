@@ -0,0 +1,294 @@
+package dmx
+
+import "slices"
+
+type MergeConflictKind int
+
+const (
+	CONFLICT_ATTRIBUTE     MergeConflictKind = iota // Both sides changed an attribute differently
+	CONFLICT_ELEMENT_NAME                           // Both sides renamed an element differently
+	CONFLICT_ELEMENT_TYPE                           // Both sides changed the type of an element differently
+	CONFLICT_MODIFY_DELETE                          // One side modified an element the other side no longer references
+)
+
+var conflictKindToString = [...]string{
+	"attribute",
+	"element name",
+	"element type",
+	"modify/delete",
+}
+
+func (kind MergeConflictKind) String() string {
+	if kind < 0 || int(kind) >= len(conflictKindToString) {
+		return "unknown"
+	}
+	return conflictKindToString[kind]
+}
+
+// MergeConflict describes a change that couldn't be merged, the merged graph keeps our side
+type MergeConflict struct {
+	Kind      MergeConflictKind
+	Id        DmObjectId // Id of the conflicting element
+	Path      string     // Path of the element in theirs, or in ours if theirs no longer references it
+	Attribute string     // Name of the attribute for CONFLICT_ATTRIBUTE
+	Base      interface{}
+	Ours      interface{}
+	Theirs    interface{}
+}
+
+type mergeContext struct {
+	result map[DmObjectId]*DmElement
+}
+
+// Merge merges the changes made in theirs since base into a copy of ours.
+// Elements are matched by id. Element arrays changed on both sides are merged by keeping the order of the side
+// that reordered the array, our order if none did, then appending the elements added by the other side
+// and removing the elements removed by the other side. Arrays reordered differently on both sides are a conflict.
+// Conflicting changes keep our side and are reported.
+func Merge(base *DmElement, ours *DmElement, theirs *DmElement) (*DmElement, []MergeConflict) {
+	result, _ := Clone(ours, CloneOptions{PreserveIds: true})
+
+	context := &mergeContext{
+		result: make(map[DmObjectId]*DmElement),
+	}
+	for _, e := range DepthFirst(result) {
+		context.result[e.id] = e
+	}
+
+	baseElements := make(map[DmObjectId]*DmElement)
+	for _, e := range DepthFirst(base) {
+		baseElements[e.id] = e
+	}
+
+	conflicts := make([]MergeConflict, 0)
+	theirsGraph := newDiffGraph(theirs)
+	for _, t := range theirsGraph.elements {
+		b, exist := baseElements[t.id]
+		if !exist {
+			// Added by theirs, it is copied when referenced
+			continue
+		}
+		if !elementChanged(b, t) {
+			continue
+		}
+
+		r, exist := context.result[t.id]
+		if !exist {
+			conflicts = append(conflicts, MergeConflict{Kind: CONFLICT_MODIFY_DELETE, Id: t.id, Path: theirsGraph.paths[t], Base: b, Theirs: t})
+			continue
+		}
+
+		if t.Name != b.Name && r.Name != t.Name {
+			if r.Name == b.Name {
+				r.Name = t.Name
+			} else {
+				conflicts = append(conflicts, MergeConflict{Kind: CONFLICT_ELEMENT_NAME, Id: t.id, Path: theirsGraph.paths[t], Base: b.Name, Ours: r.Name, Theirs: t.Name})
+			}
+		}
+
+		if t.elementType != b.elementType && r.elementType != t.elementType {
+			if r.elementType == b.elementType {
+				r.elementType = t.elementType
+			} else {
+				conflicts = append(conflicts, MergeConflict{Kind: CONFLICT_ELEMENT_TYPE, Id: t.id, Path: theirsGraph.paths[t], Base: b.elementType, Ours: r.elementType, Theirs: t.elementType})
+			}
+		}
+
+		for _, name := range mergedAttributeNames(b, t) {
+			ba, ta, ra := b.attributes[name], t.attributes[name], r.attributes[name]
+			if attributesEqual(ba, ta) || attributesEqual(ra, ta) {
+				continue
+			}
+
+			switch {
+			case attributesEqual(ba, ra):
+				setMergedAttribute(context, r, name, ta)
+			case ba != nil && ta != nil && ra != nil && ba.attributeType == AT_ELEMENT_ARRAY && ta.attributeType == AT_ELEMENT_ARRAY && ra.attributeType == AT_ELEMENT_ARRAY:
+				if merged, ok := mergeElementArrays(context, ba.value.([]*DmElement), ra.value.([]*DmElement), ta.value.([]*DmElement)); ok {
+					ra.value = merged
+					break
+				}
+				fallthrough
+			default:
+				conflicts = append(conflicts, MergeConflict{Kind: CONFLICT_ATTRIBUTE, Id: t.id, Path: theirsGraph.paths[t], Attribute: name, Base: attributeValue(ba), Ours: attributeValue(ra), Theirs: attributeValue(ta)})
+			}
+		}
+	}
+
+	// Elements modified by ours that theirs no longer references
+	theirIds := make(map[DmObjectId]struct{}, len(theirsGraph.elements))
+	for _, t := range theirsGraph.elements {
+		theirIds[t.id] = struct{}{}
+	}
+	oursGraph := newDiffGraph(ours)
+	for _, o := range oursGraph.elements {
+		b, exist := baseElements[o.id]
+		if !exist || !elementChanged(b, o) {
+			continue
+		}
+		if _, exist := theirIds[o.id]; !exist {
+			conflicts = append(conflicts, MergeConflict{Kind: CONFLICT_MODIFY_DELETE, Id: o.id, Path: oursGraph.paths[o], Base: b, Ours: o})
+		}
+	}
+
+	return result, conflicts
+}
+
+// elementChanged returns true if t differs from b
+func elementChanged(b *DmElement, t *DmElement) bool {
+	if b.Name != t.Name || b.elementType != t.elementType || len(b.orderedAttributes) != len(t.orderedAttributes) {
+		return true
+	}
+	for _, ta := range t.orderedAttributes {
+		if !attributesEqual(b.attributes[ta.name], ta) {
+			return true
+		}
+	}
+	return false
+}
+
+func mergedAttributeNames(b *DmElement, t *DmElement) []string {
+	names := make([]string, 0, len(t.orderedAttributes))
+	for _, a := range t.orderedAttributes {
+		names = append(names, a.name)
+	}
+	for _, a := range b.orderedAttributes {
+		if _, exist := t.attributes[a.name]; !exist {
+			names = append(names, a.name)
+		}
+	}
+	return names
+}
+
+// attributesEqual compares attributes of different graphs, elements are compared by id
+func attributesEqual(a *DmAttribute, b *DmAttribute) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.attributeType == b.attributeType && valuesEqual(a.value, b.value, 0, elementIdsEqual)
+}
+
+func elementIdsEqual(a *DmElement, b *DmElement) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.id == b.id
+}
+
+func attributeValue(attribute *DmAttribute) interface{} {
+	if attribute == nil {
+		return nil
+	}
+	return attribute.value
+}
+
+// setMergedAttribute sets the attribute name of r to the value of ta, or removes it if ta is nil
+func setMergedAttribute(context *mergeContext, r *DmElement, name string, ta *DmAttribute) {
+	if ta == nil {
+		r.RemoveAttribute(name)
+		return
+	}
+
+	ra := r.attributes[name]
+	if ra == nil {
+		ra = r.CreateAttribute(name, ta.attributeType)
+	} else {
+		ra.attributeType = ta.attributeType
+	}
+
+	switch ta.attributeType {
+	case AT_ELEMENT:
+		ra.value = mergedElement(context, ta.value.(*DmElement))
+	case AT_ELEMENT_ARRAY:
+		children := ta.value.([]*DmElement)
+		a := make([]*DmElement, len(children))
+		for k, child := range children {
+			a[k] = mergedElement(context, child)
+		}
+		ra.value = a
+	default:
+		ra.value = copyValue(ta.value)
+	}
+}
+
+// mergedElement returns the element of the result with the same id as t, copying t if needed
+func mergedElement(context *mergeContext, t *DmElement) *DmElement {
+	if t == nil {
+		return nil
+	}
+	if r, exist := context.result[t.id]; exist {
+		return r
+	}
+
+	r := newDmElementWithId(t.Name, t.elementType, t.id)
+	context.result[t.id] = r
+	for _, ta := range t.orderedAttributes {
+		setMergedAttribute(context, r, ta.name, ta)
+	}
+	return r
+}
+
+// mergeElementArrays merges element arrays changed on both sides, it returns false if both sides reordered the array differently
+func mergeElementArrays(context *mergeContext, b []*DmElement, r []*DmElement, t []*DmElement) ([]*DmElement, bool) {
+	contains := func(a []*DmElement, e *DmElement) bool {
+		for _, v := range a {
+			if elementIdsEqual(v, e) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Order of the elements present on all sides
+	order := func(a []*DmElement) []*DmElement {
+		common := make([]*DmElement, 0, len(a))
+		for _, e := range a {
+			if contains(b, e) && contains(r, e) && contains(t, e) {
+				common = append(common, e)
+			}
+		}
+		return common
+	}
+	sameOrder := func(x []*DmElement, y []*DmElement) bool {
+		return slices.EqualFunc(order(x), order(y), elementIdsEqual)
+	}
+
+	theirsReordered := !sameOrder(t, b)
+	if theirsReordered && !sameOrder(r, b) && !sameOrder(r, t) {
+		return nil, false
+	}
+
+	merged := make([]*DmElement, 0, len(r)+len(t))
+	if theirsReordered {
+		// Keep their order, remove the elements removed by ours and append the elements added by ours
+		for _, e := range t {
+			if contains(b, e) && !contains(r, e) {
+				continue
+			}
+			merged = append(merged, mergedElement(context, e))
+		}
+		for _, e := range r {
+			if !contains(b, e) && !contains(t, e) {
+				merged = append(merged, e)
+			}
+		}
+		return merged, true
+	}
+
+	for _, e := range r {
+		// Remove the elements removed by theirs
+		if contains(b, e) && !contains(t, e) {
+			continue
+		}
+		merged = append(merged, e)
+	}
+
+	for _, e := range t {
+		// Append the elements added by theirs
+		if !contains(b, e) && !contains(r, e) {
+			merged = append(merged, mergedElement(context, e))
+		}
+	}
+
+	return merged, true
+}
@@ -2,20 +2,139 @@ package dmx
 
 import (
 	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 )
 
 type DmObjectId = [16]byte
 
+// NilObjectId is the all-zero id
+var NilObjectId = DmObjectId{}
+
+// ObjectIdSource generates the ids of the new elements
+type ObjectIdSource interface {
+	NewObjectId() (DmObjectId, error)
+}
+
+var objectIdSource struct {
+	sync.RWMutex
+	source ObjectIdSource
+}
+
+// SetObjectIdSource sets the source used to create the ids of new elements and returns the previous one.
+// A nil source restores the default random source.
+func SetObjectIdSource(source ObjectIdSource) ObjectIdSource {
+	objectIdSource.Lock()
+	defer objectIdSource.Unlock()
+
+	previous := objectIdSource.source
+	if previous == nil {
+		previous = RandomObjectIdSource{}
+	}
+	objectIdSource.source = source
+	return previous
+}
+
+// NewObjectId creates an id with the current id source
+func NewObjectId() (DmObjectId, error) {
+	objectIdSource.RLock()
+	source := objectIdSource.source
+	objectIdSource.RUnlock()
+
+	if source == nil {
+		source = RandomObjectIdSource{}
+	}
+	return source.NewObjectId()
+}
+
+// CreateObjectId is like NewObjectId but panics if the id can't be created
 func CreateObjectId() DmObjectId {
-	var b [16]byte
+	id, err := NewObjectId()
+	if err != nil {
+		panic("Can't create element id: " + err.Error())
+	}
+	return id
+}
+
+// RandomObjectIdSource creates random (version 4) UUIDs
+type RandomObjectIdSource struct{}
+
+func (RandomObjectIdSource) NewObjectId() (DmObjectId, error) {
+	var b DmObjectId
 
 	_, err := rand.Read(b[:])
 	if err != nil {
-		panic("Can't create element id")
+		return NilObjectId, err
 	}
 
 	b[8] = (b[8] | 0x80) & 0xBF
 	b[6] = (b[6] | 0x40) & 0x4F
 
+	return b, nil
+}
+
+// ObjectIdFromName returns the name-based (version 5) UUID of name in namespace
+func ObjectIdFromName(namespace DmObjectId, name string) DmObjectId {
+	h := sha1.New()
+	h.Write(namespace[:])
+	h.Write([]byte(name))
+
+	var b DmObjectId
+	copy(b[:], h.Sum(nil))
+
+	b[8] = (b[8] & 0x3F) | 0x80
+	b[6] = (b[6] & 0x0F) | 0x50
+
 	return b
 }
+
+// SeededObjectIdSource creates a reproducible sequence of name-based UUIDs.
+// Two sources created with the same seed return the same ids in the same order.
+type SeededObjectIdSource struct {
+	mutex     sync.Mutex
+	namespace DmObjectId
+	counter   uint64
+}
+
+func NewSeededObjectIdSource(seed string) *SeededObjectIdSource {
+	return &SeededObjectIdSource{
+		namespace: ObjectIdFromName(NilObjectId, seed),
+	}
+}
+
+func (source *SeededObjectIdSource) NewObjectId() (DmObjectId, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	var name [8]byte
+	binary.LittleEndian.PutUint64(name[:], source.counter)
+	source.counter++
+
+	return ObjectIdFromName(source.namespace, string(name[:])), nil
+}
+
+// FormatObjectId returns the UUID string of id, as in 2c4e8f5a-0b1d-4e6f-8a9b-0c1d2e3f4a5b
+func FormatObjectId(id DmObjectId) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+// ParseObjectId parses an UUID string, the dashes are optional
+func ParseObjectId(s string) (DmObjectId, error) {
+	var id DmObjectId
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil {
+		return id, errors.New("invalid element id " + s)
+	}
+	if len(b) != len(id) {
+		return id, errors.New("invalid element id length " + s)
+	}
+
+	copy(id[:], b)
+	return id, nil
+}
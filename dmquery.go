@@ -0,0 +1,440 @@
+package dmx
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// QueryResult is a node selected by a query.
+// Element is set when the node is an element, Attribute is set when the node was reached through an attribute,
+// Index is the position of the item in the array attribute or -1.
+type QueryResult struct {
+	Element   *DmElement
+	Attribute *DmAttribute
+	Index     int
+}
+
+// Value returns the element, the array item or the attribute value of the node
+func (result QueryResult) Value() interface{} {
+	switch {
+	case result.Element != nil:
+		return result.Element
+	case result.Attribute == nil:
+		return nil
+	case result.Index >= 0:
+		return reflect.ValueOf(result.Attribute.value).Index(result.Index).Interface()
+	default:
+		return result.Attribute.value
+	}
+}
+
+type queryStepKind int
+
+const (
+	queryStepAttribute   queryStepKind = iota // .name or .*
+	queryStepDescendants                      // //Type or //*
+	queryStepIndex                            // [n]
+	queryStepAllItems                         // [*]
+	queryStepPredicate                        // [key], [key=value] or [key!=value]
+)
+
+type queryStep struct {
+	kind     queryStepKind
+	name     string
+	index    int
+	operator string
+	value    string
+}
+
+// DmQuery is a compiled path query.
+//
+// A query is a sequence of steps evaluated from a start element:
+//
+//	root                  the start element, only allowed at the beginning of the query
+//	.name                 the attribute name of the current elements, "*" selects all attributes.
+//	                      An element attribute selects the referenced element.
+//	//Type                the current elements and all the elements reachable from them whose type is Type, "*" matches any type
+//	[n]                   the item n of the current array attributes, negative indices count from the end
+//	[*]                   all the items of the current array attributes
+//	[name="value"]        the current elements whose name is value, other keys are type, id and any scalar attribute.
+//	                      The operator can also be != and [key] only tests if the key exists.
+//
+// Names and values containing special characters can be quoted, as in ."my attribute".
+// For example root.skeleton.children[*].transform.position or //DmeChannel[name="rootTransform_p"].
+type DmQuery struct {
+	source string
+	steps  []queryStep
+}
+
+func (query *DmQuery) String() string {
+	return query.source
+}
+
+// Select runs the query from root and returns the selected nodes in graph order without duplicates
+func Select(root *DmElement, query string) ([]QueryResult, error) {
+	q, err := CompileQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return q.Run(root), nil
+}
+
+// SelectElements runs the query from root and returns the selected elements
+func SelectElements(root *DmElement, query string) ([]*DmElement, error) {
+	results, err := Select(root, query)
+	if err != nil {
+		return nil, err
+	}
+
+	elements := make([]*DmElement, 0, len(results))
+	for _, r := range results {
+		if r.Element != nil {
+			elements = append(elements, r.Element)
+		}
+	}
+	return elements, nil
+}
+
+// SelectAttributes runs the query from root and returns the attributes of the selected nodes
+func SelectAttributes(root *DmElement, query string) ([]*DmAttribute, error) {
+	results, err := Select(root, query)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := make([]*DmAttribute, 0, len(results))
+	seen := make(map[*DmAttribute]struct{})
+	for _, r := range results {
+		if r.Attribute == nil {
+			continue
+		}
+		if _, exist := seen[r.Attribute]; !exist {
+			seen[r.Attribute] = struct{}{}
+			attributes = append(attributes, r.Attribute)
+		}
+	}
+	return attributes, nil
+}
+
+// Run evaluates the query from root
+func (query *DmQuery) Run(root *DmElement) []QueryResult {
+	if root == nil {
+		return []QueryResult{}
+	}
+
+	nodes := []QueryResult{{Element: root, Index: -1}}
+	for _, step := range query.steps {
+		nodes = dedupQueryResults(runQueryStep(step, nodes))
+	}
+	return nodes
+}
+
+func runQueryStep(step queryStep, nodes []QueryResult) []QueryResult {
+	results := make([]QueryResult, 0, len(nodes))
+
+	switch step.kind {
+	case queryStepAttribute:
+		for _, node := range nodes {
+			if node.Element == nil {
+				continue
+			}
+			for _, a := range node.Element.orderedAttributes {
+				if step.name != "*" && a.name != step.name {
+					continue
+				}
+				result := QueryResult{Attribute: a, Index: -1}
+				if e, ok := a.value.(*DmElement); ok {
+					result.Element = e
+				}
+				results = append(results, result)
+			}
+		}
+	case queryStepDescendants:
+		for _, node := range nodes {
+			for _, e := range DepthFirst(node.Element) {
+				if step.name == "*" || e.elementType == step.name {
+					results = append(results, QueryResult{Element: e, Index: -1})
+				}
+			}
+		}
+	case queryStepIndex, queryStepAllItems:
+		for _, node := range nodes {
+			length := arrayNodeLen(node)
+			if step.kind == queryStepAllItems {
+				for i := 0; i < length; i++ {
+					results = appendArrayItem(results, node.Attribute, i)
+				}
+				continue
+			}
+
+			i := step.index
+			if i < 0 {
+				i += length
+			}
+			if i >= 0 && i < length {
+				results = appendArrayItem(results, node.Attribute, i)
+			}
+		}
+	case queryStepPredicate:
+		for _, node := range nodes {
+			if length := arrayNodeLen(node); length > 0 && node.Attribute.attributeType == AT_ELEMENT_ARRAY {
+				// Filter the elements of the array
+				items := make([]QueryResult, 0, length)
+				for i := 0; i < length; i++ {
+					items = appendArrayItem(items, node.Attribute, i)
+				}
+				for _, item := range items {
+					if matchQueryPredicate(step, item.Element) {
+						results = append(results, item)
+					}
+				}
+				continue
+			}
+			if node.Element != nil && matchQueryPredicate(step, node.Element) {
+				results = append(results, node)
+			}
+		}
+	}
+
+	return results
+}
+
+// arrayNodeLen returns the length of the array attribute of a node that isn't already an array item, or 0
+func arrayNodeLen(node QueryResult) int {
+	if node.Attribute == nil || node.Index >= 0 || node.Attribute.attributeType < AT_FIRST_ARRAY_TYPE {
+		return 0
+	}
+	v := reflect.ValueOf(node.Attribute.value)
+	if v.Kind() != reflect.Slice {
+		return 0
+	}
+	return v.Len()
+}
+
+func appendArrayItem(results []QueryResult, attribute *DmAttribute, index int) []QueryResult {
+	result := QueryResult{Attribute: attribute, Index: index}
+	if attribute.attributeType == AT_ELEMENT_ARRAY {
+		result.Element = attribute.value.([]*DmElement)[index]
+		if result.Element == nil {
+			return results
+		}
+	}
+	return append(results, result)
+}
+
+func matchQueryPredicate(step queryStep, element *DmElement) bool {
+	if element == nil {
+		return false
+	}
+
+	var value string
+	switch step.name {
+	case "name":
+		value = element.Name
+	case "type":
+		value = element.elementType
+	case "id":
+		value = FormatObjectId(element.id)
+	default:
+		a := element.attributes[step.name]
+		if a == nil {
+			return false
+		}
+		if step.operator == "" {
+			return true
+		}
+		if a.attributeType == AT_ELEMENT || a.attributeType >= AT_FIRST_ARRAY_TYPE {
+			return false
+		}
+		value = a.StringValue()
+	}
+
+	switch step.operator {
+	case "=":
+		return value == step.value
+	case "!=":
+		return value != step.value
+	default:
+		return true
+	}
+}
+
+func dedupQueryResults(results []QueryResult) []QueryResult {
+	seen := make(map[QueryResult]struct{}, len(results))
+	deduped := results[:0]
+	for _, r := range results {
+		if _, exist := seen[r]; !exist {
+			seen[r] = struct{}{}
+			deduped = append(deduped, r)
+		}
+	}
+	return deduped
+}
+
+type queryParser struct {
+	source string
+	pos    int
+}
+
+// CompileQuery parses a query, see DmQuery for the syntax
+func CompileQuery(query string) (*DmQuery, error) {
+	p := &queryParser{source: query}
+	steps := make([]queryStep, 0, 8)
+
+	first := true
+	for p.pos < len(p.source) {
+		switch {
+		case strings.HasPrefix(p.source[p.pos:], "//"):
+			p.pos += 2
+			name, err := p.readName()
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, queryStep{kind: queryStepDescendants, name: name})
+		case p.source[p.pos] == '[':
+			if first {
+				return nil, p.errorf("expecting an attribute name")
+			}
+			step, err := p.readBracket()
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
+		case p.source[p.pos] == '.' || first:
+			if p.source[p.pos] == '.' {
+				p.pos++
+			}
+			name, err := p.readName()
+			if err != nil {
+				return nil, err
+			}
+			if first && name == "root" {
+				break
+			}
+			steps = append(steps, queryStep{kind: queryStepAttribute, name: name})
+		default:
+			return nil, p.errorf("unexpected character %q", p.source[p.pos])
+		}
+		first = false
+	}
+
+	return &DmQuery{source: query, steps: steps}, nil
+}
+
+func (p *queryParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("invalid query %q at offset %d: %s", p.source, p.pos, fmt.Sprintf(format, a...))
+}
+
+func isQuerySeparator(c byte) bool {
+	return strings.IndexByte(".[]/=!\" \t", c) >= 0
+}
+
+// readName reads a bare or quoted name, or *
+func (p *queryParser) readName() (string, error) {
+	if p.pos < len(p.source) && p.source[p.pos] == '"' {
+		return p.readQuoted()
+	}
+
+	start := p.pos
+	for p.pos < len(p.source) && !isQuerySeparator(p.source[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expecting a name")
+	}
+	return p.source[start:p.pos], nil
+}
+
+func (p *queryParser) readQuoted() (string, error) {
+	p.pos++ // opening quote
+
+	var sb strings.Builder
+	for p.pos < len(p.source) {
+		c := p.source[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if p.pos < len(p.source) {
+				sb.WriteByte(p.source[p.pos])
+				p.pos++
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *queryParser) skipSpaces() {
+	for p.pos < len(p.source) && (p.source[p.pos] == ' ' || p.source[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *queryParser) expect(c byte) error {
+	p.skipSpaces()
+	if p.pos >= len(p.source) || p.source[p.pos] != c {
+		return p.errorf("expecting %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *queryParser) readBracket() (queryStep, error) {
+	p.pos++ // [
+	p.skipSpaces()
+
+	end := strings.IndexByte(p.source[p.pos:], ']')
+	if end < 0 {
+		return queryStep{}, p.errorf("expecting ']'")
+	}
+
+	content := strings.TrimSpace(p.source[p.pos : p.pos+end])
+	if content == "*" {
+		p.pos += end + 1
+		return queryStep{kind: queryStepAllItems}, nil
+	}
+	if i, err := strconv.Atoi(content); err == nil {
+		p.pos += end + 1
+		return queryStep{kind: queryStepIndex, index: i}, nil
+	}
+
+	step := queryStep{kind: queryStepPredicate}
+	name, err := p.readName()
+	if err != nil {
+		return step, err
+	}
+	step.name = name
+
+	p.skipSpaces()
+	switch {
+	case strings.HasPrefix(p.source[p.pos:], "!="):
+		step.operator = "!="
+		p.pos += 2
+	case strings.HasPrefix(p.source[p.pos:], "="):
+		step.operator = "="
+		p.pos++
+	}
+
+	if step.operator != "" {
+		p.skipSpaces()
+		if p.pos < len(p.source) && p.source[p.pos] == '"' {
+			step.value, err = p.readQuoted()
+			if err != nil {
+				return step, err
+			}
+		} else {
+			start := p.pos
+			for p.pos < len(p.source) && p.source[p.pos] != ']' {
+				p.pos++
+			}
+			step.value = strings.TrimSpace(p.source[start:p.pos])
+		}
+	}
+
+	return step, p.expect(']')
+}
@@ -0,0 +1,78 @@
+package dmx
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// DmTime is a time in ticks, the value of time attributes
+type DmTime int32
+
+const DMTIME_TICKS_PER_SECOND = 10000
+
+const (
+	DMTIME_MIN DmTime = math.MinInt32 + 1
+	DMTIME_MAX DmTime = math.MaxInt32
+)
+
+// DmTimeFromSeconds returns the nearest time to seconds, clamped to the representable range
+func DmTimeFromSeconds(seconds float64) DmTime {
+	return dmTimeFromTicks(math.Round(seconds * DMTIME_TICKS_PER_SECOND))
+}
+
+// DmTimeFromDuration returns the nearest time to d, clamped to the representable range
+func DmTimeFromDuration(d time.Duration) DmTime {
+	return dmTimeFromTicks(float64(d.Round(time.Second/DMTIME_TICKS_PER_SECOND) / (time.Second / DMTIME_TICKS_PER_SECOND)))
+}
+
+// DmTimeFromFrame returns the nearest time to the start of frame at frameRate frames per second.
+// It returns 0 if frameRate is not a positive number.
+func DmTimeFromFrame(frame int, frameRate float64) DmTime {
+	if !(frameRate > 0) {
+		return 0
+	}
+	return dmTimeFromTicks(math.Round(float64(frame) * DMTIME_TICKS_PER_SECOND / frameRate))
+}
+
+func dmTimeFromTicks(ticks float64) DmTime {
+	switch {
+	case ticks < float64(DMTIME_MIN):
+		return DMTIME_MIN
+	case ticks > float64(DMTIME_MAX):
+		return DMTIME_MAX
+	default:
+		return DmTime(ticks)
+	}
+}
+
+func (t DmTime) Seconds() float64 {
+	return float64(t) / DMTIME_TICKS_PER_SECOND
+}
+
+func (t DmTime) Duration() time.Duration {
+	return time.Duration(t) * (time.Second / DMTIME_TICKS_PER_SECOND)
+}
+
+// Frame returns the nearest frame number at frameRate frames per second, it is the inverse of DmTimeFromFrame.
+// It returns 0 if frameRate is not a positive finite number.
+func (t DmTime) Frame(frameRate float64) int {
+	if !(frameRate > 0) || math.IsInf(frameRate, 1) {
+		return 0
+	}
+	return int(math.Round(t.Seconds() * frameRate))
+}
+
+// String returns the time in seconds, as written in keyvalues2 files
+func (t DmTime) String() string {
+	return strconv.FormatFloat(t.Seconds(), 'f', -1, 64)
+}
+
+// parseDmTime parses a time in seconds
+func parseDmTime(s string) (DmTime, error) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return DmTimeFromSeconds(seconds), nil
+}
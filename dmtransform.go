@@ -0,0 +1,216 @@
+package dmx
+
+import (
+	"reflect"
+	"slices"
+)
+
+// Visitor is called once per element reachable from the root, then once per attribute of that element
+type Visitor interface {
+	VisitElement(element *DmElement) error
+	VisitAttribute(attribute *DmAttribute) error
+}
+
+// VisitFuncs implements Visitor with optional functions
+type VisitFuncs struct {
+	Element   func(element *DmElement) error
+	Attribute func(attribute *DmAttribute) error
+}
+
+func (v VisitFuncs) VisitElement(element *DmElement) error {
+	if v.Element == nil {
+		return nil
+	}
+	return v.Element(element)
+}
+
+func (v VisitFuncs) VisitAttribute(attribute *DmAttribute) error {
+	if v.Attribute == nil {
+		return nil
+	}
+	return v.Attribute(attribute)
+}
+
+// Visit walks the graph in depth-first order, each element is visited once.
+// The walk stops at the first error.
+func Visit(root *DmElement, visitor Visitor) error {
+	for _, element := range DepthFirst(root) {
+		if err := visitor.VisitElement(element); err != nil {
+			return err
+		}
+		for _, attribute := range element.Attributes() {
+			if err := visitor.VisitAttribute(attribute); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Transformer is called once per element reachable from the root, then once per attribute of that element.
+type Transformer interface {
+	// TransformElement returns the element itself to keep it, another element to replace it or nil to remove it.
+	// Removed elements are removed from element arrays and element attributes are set to nil.
+	// The subgraph of a replacement element is not walked.
+	TransformElement(element *DmElement) (*DmElement, error)
+	// TransformAttribute returns false to remove the attribute.
+	// The attribute can be modified in place, for instance to splice the children of an element array.
+	// Array values are compared by identity and length to detect changes, an item modified in place isn't reported:
+	// set a new array with SetValue to report it.
+	TransformAttribute(attribute *DmAttribute) (bool, error)
+}
+
+// TransformFuncs implements Transformer with optional functions
+type TransformFuncs struct {
+	Element   func(element *DmElement) (*DmElement, error)
+	Attribute func(attribute *DmAttribute) (bool, error)
+}
+
+func (t TransformFuncs) TransformElement(element *DmElement) (*DmElement, error) {
+	if t.Element == nil {
+		return element, nil
+	}
+	return t.Element(element)
+}
+
+func (t TransformFuncs) TransformAttribute(attribute *DmAttribute) (bool, error) {
+	if t.Attribute == nil {
+		return true, nil
+	}
+	return t.Attribute(attribute)
+}
+
+type TransformChangeKind int
+
+const (
+	CHANGE_ELEMENT_REPLACED TransformChangeKind = iota
+	CHANGE_ELEMENT_REMOVED
+	CHANGE_ATTRIBUTE_REMOVED
+	CHANGE_ELEMENT_MODIFIED   // The name, type, id or attribute list of a kept element changed in TransformElement
+	CHANGE_ATTRIBUTE_MODIFIED // The name, type or value of a kept attribute changed in TransformAttribute
+)
+
+type TransformChange struct {
+	Kind        TransformChangeKind
+	Element     *DmElement // The replaced, removed or modified element, or the owner of the removed or modified attribute
+	Replacement *DmElement // The replacement element for CHANGE_ELEMENT_REPLACED
+	Attribute   *DmAttribute
+}
+
+type TransformReport struct {
+	Changes []TransformChange
+}
+
+type transformContext struct {
+	transformer Transformer
+	processed   map[*DmElement]*DmElement
+	report      *TransformReport
+}
+
+// Transform walks the graph in depth-first order and applies transformer to each element once,
+// shared elements and cycles are handled.
+// It returns the new root, which is nil if the root has been removed, and a report of the changes.
+func Transform(root *DmElement, transformer Transformer) (*DmElement, *TransformReport, error) {
+	context := &transformContext{
+		transformer: transformer,
+		processed:   make(map[*DmElement]*DmElement),
+		report:      &TransformReport{Changes: make([]TransformChange, 0)},
+	}
+
+	newRoot, err := transformElement(context, root)
+	if err != nil {
+		return nil, context.report, err
+	}
+
+	return newRoot, context.report, nil
+}
+
+func transformElement(context *transformContext, element *DmElement) (*DmElement, error) {
+	if element == nil {
+		return nil, nil
+	}
+	if replacement, exist := context.processed[element]; exist {
+		return replacement, nil
+	}
+
+	name, elementType, id := element.Name, element.elementType, element.id
+	attributes := slices.Clone(element.orderedAttributes)
+
+	replacement, err := context.transformer.TransformElement(element)
+	if err != nil {
+		return nil, err
+	}
+	context.processed[element] = replacement
+
+	if replacement == nil {
+		context.report.Changes = append(context.report.Changes, TransformChange{Kind: CHANGE_ELEMENT_REMOVED, Element: element})
+		return nil, nil
+	}
+	if replacement != element {
+		context.report.Changes = append(context.report.Changes, TransformChange{Kind: CHANGE_ELEMENT_REPLACED, Element: element, Replacement: replacement})
+		return replacement, nil
+	}
+	if element.Name != name || element.elementType != elementType || element.id != id || !slices.Equal(element.orderedAttributes, attributes) {
+		context.report.Changes = append(context.report.Changes, TransformChange{Kind: CHANGE_ELEMENT_MODIFIED, Element: element})
+	}
+
+	// Copy the list, the transformer may remove attributes
+	attributes = slices.Clone(element.orderedAttributes)
+	for _, attribute := range attributes {
+		name, attributeType, value := attribute.name, attribute.attributeType, attribute.value
+		keep, err := context.transformer.TransformAttribute(attribute)
+		if err != nil {
+			return nil, err
+		}
+		if keep && (attribute.name != name || attribute.attributeType != attributeType || valueChanged(value, attribute.value)) {
+			context.report.Changes = append(context.report.Changes, TransformChange{Kind: CHANGE_ATTRIBUTE_MODIFIED, Element: element, Attribute: attribute})
+		}
+
+		if !keep {
+			element.RemoveAttribute(attribute.name)
+			context.report.Changes = append(context.report.Changes, TransformChange{Kind: CHANGE_ATTRIBUTE_REMOVED, Element: element, Attribute: attribute})
+			continue
+		}
+
+		switch attribute.attributeType {
+		case AT_ELEMENT:
+			if child, ok := attribute.value.(*DmElement); ok {
+				newChild, err := transformElement(context, child)
+				if err != nil {
+					return nil, err
+				}
+				attribute.value = newChild
+			}
+		case AT_ELEMENT_ARRAY:
+			if children, ok := attribute.value.([]*DmElement); ok {
+				newChildren := make([]*DmElement, 0, len(children))
+				for _, child := range children {
+					if child == nil {
+						// Keep the null entries loaded from a file
+						newChildren = append(newChildren, nil)
+						continue
+					}
+					newChild, err := transformElement(context, child)
+					if err != nil {
+						return nil, err
+					}
+					if newChild != nil {
+						newChildren = append(newChildren, newChild)
+					}
+				}
+				attribute.value = newChildren
+			}
+		}
+	}
+
+	return element, nil
+}
+
+// valueChanged compares scalar values, arrays are compared by identity and length to not copy them
+func valueChanged(old interface{}, value interface{}) bool {
+	o, v := reflect.ValueOf(old), reflect.ValueOf(value)
+	if o.Kind() == reflect.Slice && v.Kind() == reflect.Slice {
+		return o.Type() != v.Type() || o.Pointer() != v.Pointer() || o.Len() != v.Len()
+	}
+	return !valuesEqual(old, value, 0, func(a *DmElement, b *DmElement) bool { return a == b })
+}
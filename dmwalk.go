@@ -0,0 +1,122 @@
+package dmx
+
+import "iter"
+
+// Attributes returns the attributes of the element in insertion order
+func (element *DmElement) Attributes() iter.Seq2[string, *DmAttribute] {
+	return func(yield func(string, *DmAttribute) bool) {
+		for _, a := range element.orderedAttributes {
+			if !yield(a.name, a) {
+				return
+			}
+		}
+	}
+}
+
+func (element *DmElement) AttributeCount() int {
+	return len(element.orderedAttributes)
+}
+
+// Children returns the elements referenced by the element attributes and element array attributes.
+// An element referenced several times is returned several times, nil elements are skipped.
+func (element *DmElement) Children() iter.Seq[*DmElement] {
+	return func(yield func(*DmElement) bool) {
+		for _, a := range element.orderedAttributes {
+			switch a.attributeType {
+			case AT_ELEMENT:
+				if e, ok := a.value.(*DmElement); ok && e != nil {
+					if !yield(e) {
+						return
+					}
+				}
+			case AT_ELEMENT_ARRAY:
+				if v, ok := a.value.([]*DmElement); ok {
+					for _, e := range v {
+						if e != nil && !yield(e) {
+							return
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// DepthFirst returns the elements reachable from root in depth-first order along with their depth.
+// Each element is visited once, even if it is shared or part of a cycle.
+func DepthFirst(root *DmElement) iter.Seq2[int, *DmElement] {
+	return func(yield func(int, *DmElement) bool) {
+		walkDepthFirst(root, 0, make(map[*DmElement]struct{}), yield)
+	}
+}
+
+func walkDepthFirst(element *DmElement, depth int, visited map[*DmElement]struct{}, yield func(int, *DmElement) bool) bool {
+	if element == nil {
+		return true
+	}
+	if _, exist := visited[element]; exist {
+		return true
+	}
+	visited[element] = struct{}{}
+
+	if !yield(depth, element) {
+		return false
+	}
+
+	for child := range element.Children() {
+		if !walkDepthFirst(child, depth+1, visited, yield) {
+			return false
+		}
+	}
+	return true
+}
+
+// BreadthFirst returns the elements reachable from root in breadth-first order along with their depth.
+// Each element is visited once, even if it is shared or part of a cycle.
+func BreadthFirst(root *DmElement) iter.Seq2[int, *DmElement] {
+	return func(yield func(int, *DmElement) bool) {
+		if root == nil {
+			return
+		}
+
+		type queued struct {
+			depth   int
+			element *DmElement
+		}
+
+		visited := map[*DmElement]struct{}{root: {}}
+		queue := []queued{{0, root}}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+
+			if !yield(current.depth, current.element) {
+				return
+			}
+
+			for child := range current.element.Children() {
+				if _, exist := visited[child]; !exist {
+					visited[child] = struct{}{}
+					queue = append(queue, queued{current.depth + 1, child})
+				}
+			}
+		}
+	}
+}
+
+// ReferenceCounts returns the number of references to each element reachable from root.
+// The root counts as referenced once, like in the serializers an element referenced more than once is shared.
+func ReferenceCounts(root *DmElement) map[*DmElement]int {
+	counts := make(map[*DmElement]int)
+	if root == nil {
+		return counts
+	}
+
+	counts[root] = 1
+	for _, element := range DepthFirst(root) {
+		for child := range element.Children() {
+			counts[child]++
+		}
+	}
+	return counts
+}
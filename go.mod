@@ -1,6 +1,6 @@
 module github.com/baldurstod/go-dmx
 
-go 1.22.4
+go 1.23
 
 require github.com/baldurstod/go-vector v0.0.5
 
@@ -0,0 +1,27 @@
+package dmx
+
+import (
+	"errors"
+	"io"
+)
+
+// Serialize writes root using the encoding and the format described by header
+func Serialize(w io.Writer, root *DmElement, header DmHeader) error {
+	return SerializeDocument(w, NewDmDocument(root, header))
+}
+
+// SerializeDocument writes document using the encoding and the format of its header
+func SerializeDocument(w io.Writer, document *DmDocument) error {
+	switch document.Header.Encoding {
+	case "binary":
+		return serializeBinary(w, document)
+	case "keyvalues2":
+		return serializeText(newSerializerContext(w), document)
+	case "keyvalues2_flat":
+		context := newSerializerContext(w)
+		context.flat = true
+		return serializeText(context, document)
+	default:
+		return errors.New("unsupported encoding " + document.Header.Encoding)
+	}
+}
@@ -4,38 +4,187 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
+	"io"
+	"math"
 	"strconv"
 
 	"github.com/baldurstod/go-vector"
 )
 
 func SerializeBinary(buf *bytes.Buffer, root *DmElement, format string, formatVersion int) error {
-	context := newSerializerContext(buf)
+	return SerializeBinaryVersion(buf, root, 9, format, formatVersion)
+}
+
+// SerializeBinaryVersion writes root using the binary encoding version encodingVersion.
+// Versions 1 to 5 are used by Source 1 tools, version 9 by Source 2 tools.
+func SerializeBinaryVersion(buf *bytes.Buffer, root *DmElement, encodingVersion int, format string, formatVersion int) error {
+	return SerializeBinaryTo(buf, root, encodingVersion, format, formatVersion)
+}
 
-	if _, err := buf.WriteString(fmt.Sprintf("<!-- dmx encoding binary 9 format %s %d -->\n\x00", format, formatVersion)); err != nil {
+// SerializeBinaryTo streams root to w using the binary encoding version encodingVersion
+func SerializeBinaryTo(w io.Writer, root *DmElement, encodingVersion int, format string, formatVersion int) error {
+	return serializeBinary(w, NewDmDocument(root, DmHeader{Encoding: "binary", EncodingVersion: encodingVersion, Format: format, FormatVersion: formatVersion}))
+}
+
+func serializeBinary(w io.Writer, document *DmDocument) error {
+	encodingVersion := document.Header.EncodingVersion
+	if err := checkBinaryEncodingVersion(encodingVersion); err != nil {
 		return err
 	}
-	if err := binary.Write(context.buf, binary.LittleEndian, uint32(0)); err != nil {
+
+	context := newSerializerContext(w)
+	context.encodingVersion = encodingVersion
+
+	if _, err := context.buf.WriteString(document.Header.String() + "\n\x00"); err != nil {
 		return err
 	}
+	if encodingVersion >= 9 {
+		if err := serializePrefixBinary(context, document); err != nil {
+			return err
+		}
+	} else if document.hasPrefix() {
+		return errors.New("prefix attributes require binary encoding version 9")
+	}
 
-	buildElementList(context, root)
+	if err := buildDocumentElementList(context, document); err != nil {
+		return err
+	}
+	buildStringDictionaryBinary(context)
 
-	serializeStringsBinary(context)
-	/*
-		err := serializeElementBinary(context, root)
-		if err != nil {
+	if encodingVersion >= 2 {
+		if err := serializeStringsBinary(context); err != nil {
+			return err
+		}
+	}
+
+	if err := serializeDictBinary(context); err != nil {
+		return err
+	}
+
+	return context.buf.Flush()
+}
+
+// serializePrefixBinary writes the prefix elements, the prefix attributes are written in a single element.
+// Attribute names and string values are inline since the string table is written after them.
+func serializePrefixBinary(context *serializerContext, document *DmDocument) error {
+	if !document.hasPrefix() {
+		return binary.Write(context.buf, binary.LittleEndian, uint32(0))
+	}
+
+	prefix := document.prefix
+	if err := checkPrefix(prefix); err != nil {
+		return err
+	}
+	if err := binary.Write(context.buf, binary.LittleEndian, uint32(1)); err != nil {
+		return err
+	}
+	if err := binary.Write(context.buf, binary.LittleEndian, uint32(len(prefix.orderedAttributes))); err != nil {
+		return err
+	}
+
+	context.inlineStrings = true
+	defer func() { context.inlineStrings = false }()
+
+	for _, a := range prefix.orderedAttributes {
+		if err := writeInlineStringBinary(context, a.name); err != nil {
 			return err
 		}
-	*/
+		if err := serializeAttributeBinary(context, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkBinaryEncodingVersion(encodingVersion int) error {
+	switch encodingVersion {
+	case 1, 2, 3, 4, 5, 9:
+		return nil
+	default:
+		return errors.New("unsupported binary encoding version " + strconv.Itoa(encodingVersion))
+	}
+}
+
+// attributeTypeToBinary returns the type id of an attribute type in a given binary encoding version.
+// Encoding versions prior to 9 have no uint64 types and arrays start right after the value types.
+func attributeTypeToBinary(attributeType DmAttributeType, encodingVersion int) (byte, error) {
+	if encodingVersion >= 9 {
+		return attributeType, nil
+	}
+
+	switch {
+	case attributeType == AT_UINT64 || attributeType == AT_UINT64_ARRAY:
+		return 0, errors.New("attribute type " + type_to_string[attributeType] + " requires binary encoding version 9")
+	case encodingVersion < 3 && (attributeType == AT_TIME || attributeType == AT_TIME_ARRAY):
+		return 0, errors.New("attribute type " + type_to_string[attributeType] + " requires binary encoding version 3")
+	case attributeType >= AT_FIRST_ARRAY_TYPE:
+		return attributeType - AT_FIRST_ARRAY_TYPE + AT_VMATRIX + 1, nil
+	default:
+		return attributeType, nil
+	}
+}
+
+func attributeTypeFromBinary(id byte, encodingVersion int) (DmAttributeType, error) {
+	if encodingVersion >= 9 {
+		return id, nil
+	}
+
+	attributeType := id
+	if id > AT_VMATRIX {
+		attributeType = id - AT_VMATRIX - 1 + AT_FIRST_ARRAY_TYPE
+	}
+
+	if attributeType >= AT_TYPE_COUNT || attributeType == AT_UINT64_ARRAY {
+		return AT_UNKNOWN, errors.New("unknown attribute type " + strconv.Itoa(int(id)))
+	}
+	if encodingVersion < 3 && (attributeType == AT_TIME || attributeType == AT_TIME_ARRAY) {
+		return AT_UNKNOWN, errors.New("attribute type " + type_to_string[attributeType] + " (id " + strconv.Itoa(int(id)) + ") requires binary encoding version 3, file is version " + strconv.Itoa(encodingVersion))
+	}
 
-	return serializeDictBinary(context)
+	return attributeType, nil
+}
+
+// buildStringDictionaryBinary collects the strings stored in the string table.
+// Element types and attribute names are stored in the table starting with version 2,
+// element names and string values starting with version 4.
+func buildStringDictionaryBinary(context *serializerContext) {
+	if context.encodingVersion < 2 {
+		return
+	}
+
+	for _, e := range context.dictionary2 {
+		context.addString(e.elementType)
+		if context.encodingVersion >= 4 {
+			context.addString(e.Name)
+		}
+
+		for _, a := range e.orderedAttributes {
+			context.addString(a.name)
+
+			if a.attributeType == AT_STRING && context.encodingVersion >= 4 {
+				if s, ok := a.value.(string); ok {
+					context.addString(s)
+				}
+			}
+		}
+	}
 }
 
 func serializeStringsBinary(context *serializerContext) error {
-	var count uint32 = uint32(len(context.stringDictionary))
-	binary.Write(context.buf, binary.LittleEndian, count)
+	// Indices are 16 bits before version 5, the count is 16 bits before version 4
+	count := len(context.stringDictionary)
+	if context.encodingVersion < 4 && count > math.MaxUint16 || context.encodingVersion < 5 && count > math.MaxUint16+1 {
+		return errors.New("too many strings for binary encoding version " + strconv.Itoa(context.encodingVersion))
+	}
+	var err error
+	if context.encodingVersion < 4 {
+		err = binary.Write(context.buf, binary.LittleEndian, uint16(count))
+	} else {
+		err = binary.Write(context.buf, binary.LittleEndian, uint32(count))
+	}
+	if err != nil {
+		return err
+	}
 
 	var terminator byte
 
@@ -76,13 +225,10 @@ func serializeElementBinary(context *serializerContext, element *DmElement) erro
 		return nil
 	}
 
-	typeId := context.stringDictionary[element.elementType]
-	nameId := context.stringDictionary[element.Name]
-
-	if err := binary.Write(context.buf, binary.LittleEndian, typeId); err != nil {
+	if err := writeSymbolBinary(context, element.elementType); err != nil {
 		return err
 	}
-	if err := binary.Write(context.buf, binary.LittleEndian, nameId); err != nil {
+	if err := writeStringValueBinary(context, element.Name); err != nil {
 		return err
 	}
 	if err := binary.Write(context.buf, binary.LittleEndian, element.id); err != nil {
@@ -97,140 +243,172 @@ func serializeAttributesBinary(context *serializerContext, element *DmElement) e
 		return err
 	}
 
-	for _, a := range element.attributes {
-		nameId := context.stringDictionary[a.name]
-		if err := binary.Write(context.buf, binary.LittleEndian, nameId); err != nil {
+	for _, a := range element.orderedAttributes {
+		if err := writeSymbolBinary(context, a.name); err != nil {
 			return err
 		}
-		if err := binary.Write(context.buf, binary.LittleEndian, a.attributeType); err != nil {
+		if err := serializeAttributeBinary(context, a); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		switch a.attributeType {
-		case AT_ELEMENT:
-			if v, ok := a.GetValue().(*DmElement); ok {
-				if err := serializeElementAttribute(context, v); err != nil {
-					return err
-				}
-			} else {
-				return errors.New("attribute is of type element but doesn't contain an element")
-			}
-		case AT_INT:
-			if err := serializeAttribute[int32](context, a); err != nil {
-				return err
-			}
-		case AT_FLOAT:
-			if err := serializeAttribute[float32](context, a); err != nil {
-				return err
-			}
-		case AT_BOOL:
-			if err := serializeAttribute[bool](context, a); err != nil {
-				return err
-			}
-		case AT_STRING:
-			if err := serializeStringAttribute(context, a); err != nil {
-				return err
-			}
-		case AT_TIME:
-			if err := serializeTimeAttribute(context, a); err != nil {
-				return err
-			}
-		case AT_COLOR:
-			if err := serializeAttribute[[4]byte](context, a); err != nil {
-				return err
-			}
-		case AT_VECTOR2:
-			if err := serializeAttribute[vector.Vector2[float32]](context, a); err != nil {
-				return err
-			}
-		case AT_VECTOR3:
-			if err := serializeAttribute[vector.Vector3[float32]](context, a); err != nil {
-				return err
-			}
-		case AT_VECTOR4:
-			if err := serializeAttribute[vector.Vector4[float32]](context, a); err != nil {
-				return err
-			}
-		case AT_QANGLE:
-			if err := serializeAttribute[vector.Vector3[float32]](context, a); err != nil {
-				return err
-			}
-		case AT_QUATERNION:
-			if err := serializeAttribute[vector.Quaternion[float32]](context, a); err != nil {
+// serializeAttributeBinary writes the type and the value of an attribute
+func serializeAttributeBinary(context *serializerContext, a *DmAttribute) error {
+	typeId, err := attributeTypeToBinary(a.attributeType, context.encodingVersion)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(context.buf, binary.LittleEndian, typeId); err != nil {
+		return err
+	}
+
+	switch a.attributeType {
+	case AT_ELEMENT:
+		if v, ok := a.GetValue().(*DmElement); ok {
+			if err := serializeElementAttribute(context, v); err != nil {
 				return err
 			}
-		case AT_VMATRIX:
-			if err := serializeAttribute[[16]float32](context, a); err != nil {
+		} else {
+			return errors.New("attribute is of type element but doesn't contain an element")
+		}
+	case AT_INT:
+		if err := serializeAttribute[int32](context, a); err != nil {
+			return err
+		}
+	case AT_FLOAT:
+		if err := serializeAttribute[float32](context, a); err != nil {
+			return err
+		}
+	case AT_BOOL:
+		if err := serializeAttribute[bool](context, a); err != nil {
+			return err
+		}
+	case AT_STRING:
+		if err := serializeStringAttribute(context, a); err != nil {
+			return err
+		}
+	case AT_VOID:
+		if v, ok := a.value.([]byte); ok {
+			if err := writeBlobBinary(context, v); err != nil {
 				return err
 			}
-		case AT_UINT64:
-			if err := serializeAttribute[uint64](context, a); err != nil {
+		} else {
+			return errors.New("unable to cast attribute value")
+		}
+	case AT_TIME:
+		if err := serializeAttribute[DmTime](context, a); err != nil {
+			return err
+		}
+	case AT_COLOR:
+		if err := serializeAttribute[Color](context, a); err != nil {
+			return err
+		}
+	case AT_VECTOR2:
+		if err := serializeAttribute[vector.Vector2[float32]](context, a); err != nil {
+			return err
+		}
+	case AT_VECTOR3:
+		if err := serializeAttribute[vector.Vector3[float32]](context, a); err != nil {
+			return err
+		}
+	case AT_VECTOR4:
+		if err := serializeAttribute[vector.Vector4[float32]](context, a); err != nil {
+			return err
+		}
+	case AT_QANGLE:
+		if err := serializeAttribute[vector.Vector3[float32]](context, a); err != nil {
+			return err
+		}
+	case AT_QUATERNION:
+		if err := serializeAttribute[vector.Quaternion[float32]](context, a); err != nil {
+			return err
+		}
+	case AT_VMATRIX:
+		if err := serializeAttribute[[16]float32](context, a); err != nil {
+			return err
+		}
+	case AT_UINT64:
+		if err := serializeAttribute[uint64](context, a); err != nil {
+			return err
+		}
+	case AT_ELEMENT_ARRAY:
+		if v, ok := a.GetValue().([]*DmElement); ok {
+			if err := binary.Write(context.buf, binary.LittleEndian, uint32(len(v))); err != nil {
 				return err
 			}
-		case AT_ELEMENT_ARRAY:
-			if v, ok := a.GetValue().([]*DmElement); ok {
-				if err := binary.Write(context.buf, binary.LittleEndian, uint32(len(v))); err != nil {
+			for _, e := range v {
+				if err := serializeElementAttribute(context, e); err != nil {
 					return err
 				}
-				for _, e := range v {
-					if err := serializeElementAttribute(context, e); err != nil {
-						return err
-					}
-				}
-			} else {
-				return errors.New("attribute is of type element but doesn't contain an element")
-			}
-		case AT_INT_ARRAY:
-			if err := serializeArrayAttribute[int32](context, a); err != nil {
-				return err
-			}
-		case AT_FLOAT_ARRAY:
-			if err := serializeArrayAttribute[float32](context, a); err != nil {
-				return err
-			}
-		case AT_BOOL_ARRAY:
-			if err := serializeArrayAttribute[bool](context, a); err != nil {
-				return err
 			}
-		case AT_STRING_ARRAY:
-			if err := serializeStringArrayAttribute(context, a); err != nil {
-				return err
-			}
-		case AT_TIME_ARRAY:
-			if err := serializeTimeArrayAttribute(context, a); err != nil {
-				return err
-			}
-		case AT_COLOR_ARRAY:
-			if err := serializeArrayAttribute[[4]byte](context, a); err != nil {
-				return err
-			}
-		case AT_VECTOR2_ARRAY:
-			if err := serializeArrayAttribute[vector.Vector2[float32]](context, a); err != nil {
-				return err
-			}
-		case AT_VECTOR3_ARRAY:
-			if err := serializeArrayAttribute[vector.Vector3[float32]](context, a); err != nil {
-				return err
-			}
-		case AT_VECTOR4_ARRAY:
-			if err := serializeArrayAttribute[vector.Vector4[float32]](context, a); err != nil {
-				return err
-			}
-		case AT_QUATERNION_ARRAY:
-			if err := serializeArrayAttribute[vector.Quaternion[float32]](context, a); err != nil {
-				return err
-			}
-		case AT_VMATRIX_ARRAY:
-			if err := serializeArrayAttribute[[16]float32](context, a); err != nil {
+		} else {
+			return errors.New("attribute is of type element but doesn't contain an element")
+		}
+	case AT_INT_ARRAY:
+		if err := serializeArrayAttribute[int32](context, a); err != nil {
+			return err
+		}
+	case AT_FLOAT_ARRAY:
+		if err := serializeArrayAttribute[float32](context, a); err != nil {
+			return err
+		}
+	case AT_BOOL_ARRAY:
+		if err := serializeArrayAttribute[bool](context, a); err != nil {
+			return err
+		}
+	case AT_STRING_ARRAY:
+		if err := serializeStringArrayAttribute(context, a); err != nil {
+			return err
+		}
+	case AT_VOID_ARRAY:
+		if v, ok := a.value.([][]byte); ok {
+			if err := binary.Write(context.buf, binary.LittleEndian, uint32(len(v))); err != nil {
 				return err
 			}
-		case AT_UINT64_ARRAY:
-			if err := serializeArrayAttribute[uint64](context, a); err != nil {
-				return err
+			for _, b := range v {
+				if err := writeBlobBinary(context, b); err != nil {
+					return err
+				}
 			}
-		default:
-			return errors.New("unknown attribute type " + strconv.Itoa(int(a.attributeType)))
+		} else {
+			return errors.New("unable to cast attribute value")
+		}
+	case AT_TIME_ARRAY:
+		if err := serializeArrayAttribute[DmTime](context, a); err != nil {
+			return err
+		}
+	case AT_COLOR_ARRAY:
+		if err := serializeArrayAttribute[Color](context, a); err != nil {
+			return err
+		}
+	case AT_VECTOR2_ARRAY:
+		if err := serializeArrayAttribute[vector.Vector2[float32]](context, a); err != nil {
+			return err
+		}
+	case AT_VECTOR3_ARRAY, AT_QANGLE_ARRAY:
+		if err := serializeArrayAttribute[vector.Vector3[float32]](context, a); err != nil {
+			return err
+		}
+	case AT_VECTOR4_ARRAY:
+		if err := serializeArrayAttribute[vector.Vector4[float32]](context, a); err != nil {
+			return err
+		}
+	case AT_QUATERNION_ARRAY:
+		if err := serializeArrayAttribute[vector.Quaternion[float32]](context, a); err != nil {
+			return err
+		}
+	case AT_VMATRIX_ARRAY:
+		if err := serializeArrayAttribute[[16]float32](context, a); err != nil {
+			return err
+		}
+	case AT_UINT64_ARRAY:
+		if err := serializeArrayAttribute[uint64](context, a); err != nil {
+			return err
 		}
+	default:
+		return errors.New("unknown attribute type " + strconv.Itoa(int(a.attributeType)))
 	}
 	return nil
 }
@@ -253,7 +431,7 @@ func serializeElementAttribute(context *serializerContext, v *DmElement) error {
 	return nil
 }
 
-func serializeAttribute[T int32 | float32 | bool | [4]byte | vector.Vector2[float32] | vector.Vector3[float32] | vector.Vector4[float32] | vector.Quaternion[float32] | [16]float32 | uint64](context *serializerContext, attribute *DmAttribute) error {
+func serializeAttribute[T int32 | float32 | DmTime | bool | Color | vector.Vector2[float32] | vector.Vector3[float32] | vector.Vector4[float32] | vector.Quaternion[float32] | [16]float32 | uint64](context *serializerContext, attribute *DmAttribute) error {
 	if v, ok := attribute.value.(T); ok {
 		if err := binary.Write(context.buf, binary.LittleEndian, v); err != nil {
 			return err
@@ -267,20 +445,9 @@ func serializeAttribute[T int32 | float32 | bool | [4]byte | vector.Vector2[floa
 
 func serializeStringAttribute(context *serializerContext, attribute *DmAttribute) error {
 	if v, ok := attribute.value.(string); ok {
-		stringId := context.stringDictionary[v]
-
-		if err := binary.Write(context.buf, binary.LittleEndian, stringId); err != nil {
+		if err := writeStringValueBinary(context, v); err != nil {
 			return err
 		}
-
-		/*
-			if err := binary.Write(context.buf, binary.LittleEndian, []byte(v)); err != nil {
-				return err
-			}
-			if err := binary.Write(context.buf, binary.LittleEndian, byte(0)); err != nil {
-				return err
-			}
-		*/
 	} else {
 		return errors.New("unable to cast attribute value")
 	}
@@ -288,19 +455,7 @@ func serializeStringAttribute(context *serializerContext, attribute *DmAttribute
 	return nil
 }
 
-func serializeTimeAttribute(context *serializerContext, attribute *DmAttribute) error {
-	if v, ok := attribute.value.(float32); ok {
-		if err := binary.Write(context.buf, binary.LittleEndian, int32(v*10000)); err != nil {
-			return err
-		}
-	} else {
-		return errors.New("unable to cast attribute value")
-	}
-
-	return nil
-}
-
-func serializeArrayAttribute[T int32 | float32 | bool | [4]byte | vector.Vector2[float32] | vector.Vector3[float32] | vector.Vector4[float32] | vector.Quaternion[float32] | [16]float32 | uint64](context *serializerContext, attribute *DmAttribute) error {
+func serializeArrayAttribute[T int32 | float32 | DmTime | bool | Color | vector.Vector2[float32] | vector.Vector3[float32] | vector.Vector4[float32] | vector.Quaternion[float32] | [16]float32 | uint64](context *serializerContext, attribute *DmAttribute) error {
 	if v, ok := attribute.value.([]T); ok {
 		if err := binary.Write(context.buf, binary.LittleEndian, uint32(len(v))); err != nil {
 			return err
@@ -337,19 +492,43 @@ func serializeStringArrayAttribute(context *serializerContext, attribute *DmAttr
 	return nil
 }
 
-func serializeTimeArrayAttribute(context *serializerContext, attribute *DmAttribute) error {
-	if v, ok := attribute.value.([]float32); ok {
-		if err := binary.Write(context.buf, binary.LittleEndian, uint32(len(v))); err != nil {
-			return err
-		}
-		for _, e := range v {
-			if err := binary.Write(context.buf, binary.LittleEndian, int32(e*10000)); err != nil {
-				return err
-			}
-		}
-	} else {
-		return errors.New("unable to cast attribute value")
+// writeSymbolBinary writes an element type or an attribute name
+func writeSymbolBinary(context *serializerContext, s string) error {
+	if context.encodingVersion < 2 {
+		return writeInlineStringBinary(context, s)
 	}
 
-	return nil
+	stringId, ok := context.stringDictionary[s]
+	if !ok {
+		return errors.New("missing string dictionary entry for " + s)
+	}
+
+	if context.encodingVersion < 5 {
+		return binary.Write(context.buf, binary.LittleEndian, uint16(stringId))
+	}
+	return binary.Write(context.buf, binary.LittleEndian, stringId)
+}
+
+// writeBlobBinary writes a binary value prefixed by its length
+func writeBlobBinary(context *serializerContext, b []byte) error {
+	if err := binary.Write(context.buf, binary.LittleEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err := context.buf.Write(b)
+	return err
+}
+
+// writeStringValueBinary writes an element name or a string attribute value
+func writeStringValueBinary(context *serializerContext, s string) error {
+	if context.encodingVersion < 4 || context.inlineStrings {
+		return writeInlineStringBinary(context, s)
+	}
+	return writeSymbolBinary(context, s)
+}
+
+func writeInlineStringBinary(context *serializerContext, s string) error {
+	if err := binary.Write(context.buf, binary.LittleEndian, []byte(s)); err != nil {
+		return err
+	}
+	return binary.Write(context.buf, binary.LittleEndian, byte(0))
 }
@@ -1,9 +1,13 @@
 package dmx
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"strconv"
+	"strings"
 
 	"github.com/baldurstod/go-vector"
 )
@@ -23,23 +27,29 @@ const (
 	TOKEN_EOF              // End of buffer
 )
 
+// textEscaper escapes the strings written between quotes
+var textEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\t", "\\t")
+
 type elemDict struct {
 	depth int
 	id    int32
 }
 
 type serializerContext struct {
-	buf               *bytes.Buffer
+	buf               *bufio.Writer
 	dictionary        map[*DmElement]*elemDict
 	dictionary2       []*DmElement
 	stringDictionary  map[string]uint32
 	stringDictionary2 []string
 	tabs              int
+	encodingVersion   int
+	inlineStrings     bool // string values are written inline, for the binary prefix attributes
+	flat              bool
 }
 
-func newSerializerContext(buf *bytes.Buffer) *serializerContext {
+func newSerializerContext(w io.Writer) *serializerContext {
 	return &serializerContext{
-		buf:               buf,
+		buf:               bufio.NewWriterSize(w, 64*1024),
 		dictionary:        make(map[*DmElement]*elemDict),
 		dictionary2:       make([]*DmElement, 0, 512),
 		stringDictionary:  make(map[string]uint32),
@@ -63,23 +73,76 @@ func (context *serializerContext) addElement(e *DmElement) {
 }
 
 func SerializeText(buf *bytes.Buffer, root *DmElement, format string, formatVersion int) error {
-	context := newSerializerContext(buf)
+	return SerializeTextTo(buf, root, format, formatVersion)
+}
+
+func SerializeTextTo(w io.Writer, root *DmElement, format string, formatVersion int) error {
+	return serializeText(newSerializerContext(w), NewDmDocument(root, DmHeader{Encoding: "keyvalues2", EncodingVersion: 4, Format: format, FormatVersion: formatVersion}))
+}
+
+// SerializeTextFlat writes every element at top level and references them by id
+func SerializeTextFlat(buf *bytes.Buffer, root *DmElement, format string, formatVersion int) error {
+	return SerializeTextFlatTo(buf, root, format, formatVersion)
+}
+
+func SerializeTextFlatTo(w io.Writer, root *DmElement, format string, formatVersion int) error {
+	context := newSerializerContext(w)
+	context.flat = true
+	return serializeText(context, NewDmDocument(root, DmHeader{Encoding: "keyvalues2_flat", EncodingVersion: 4, Format: format, FormatVersion: formatVersion}))
+}
 
-	if _, err := buf.WriteString(fmt.Sprintf("<!-- dmx encoding keyvalues2 4 format %s %d -->\n", format, formatVersion)); err != nil {
+func serializeText(context *serializerContext, document *DmDocument) error {
+	header := document.Header
+	if header.EncodingVersion == 0 {
+		header.EncodingVersion = 4
+	}
+	if _, err := context.buf.WriteString(header.String() + "\n"); err != nil {
 		return err
 	}
 
-	if err := buildElementList(context, root); err != nil {
+	if document.hasPrefix() {
+		if err := checkPrefix(document.prefix); err != nil {
+			return err
+		}
+		if err := serializeElementText(context, document.prefix); err != nil {
+			return err
+		}
+		newLine(context)
+	}
+
+	if err := buildDocumentElementList(context, document); err != nil {
 		return err
 	}
 
-	err := serializeElementText(context, root)
+	err := serializeElementText(context, document.Root)
 	if err != nil {
 		return err
 	}
 
 	newLine(context)
-	return serializeDictText(context)
+	if err := serializeDictText(context, document.Root); err != nil {
+		return err
+	}
+
+	return context.buf.Flush()
+}
+
+// buildDocumentElementList adds the elements reachable from the root, then the other elements owned by the document.
+// Owned elements that aren't reachable from the root are written at top level.
+func buildDocumentElementList(context *serializerContext, document *DmDocument) error {
+	if err := buildElementList(context, document.Root); err != nil {
+		return err
+	}
+
+	for _, e := range document.elements {
+		if _, exist := context.dictionary[e]; !exist {
+			if err := buildElementList(context, e); err != nil {
+				return err
+			}
+			context.dictionary[e].depth++
+		}
+	}
+	return nil
 }
 
 func buildElementList(context *serializerContext, element *DmElement) error {
@@ -95,12 +158,7 @@ func buildElementList(context *serializerContext, element *DmElement) error {
 		context.addElement(element)
 	}
 
-	context.addString(element.elementType)
-	context.addString(element.Name)
-
-	for _, v := range element.attributes {
-		context.addString(v.name)
-
+	for _, v := range element.orderedAttributes {
 		switch v.attributeType {
 		case AT_ELEMENT:
 			e, ok := v.value.(*DmElement)
@@ -114,18 +172,13 @@ func buildElementList(context *serializerContext, element *DmElement) error {
 					buildElementList(context, e)
 				}
 			}
-		case AT_STRING:
-			e, ok := v.value.(string)
-			if ok {
-				context.addString(e)
-			}
 		}
 	}
 	return nil
 }
 
 func shouldInlineElement(context *serializerContext, element *DmElement) bool {
-	if element == nil {
+	if element == nil || context.flat {
 		return false
 	}
 	v, exist := context.dictionary[element]
@@ -135,9 +188,9 @@ func shouldInlineElement(context *serializerContext, element *DmElement) bool {
 	return true
 }
 
-func serializeDictText(context *serializerContext) error {
-	for e, i := range context.dictionary {
-		if i.depth > 1 {
+func serializeDictText(context *serializerContext, root *DmElement) error {
+	for _, e := range context.dictionary2 {
+		if (context.dictionary[e].depth > 1 || context.flat) && e != root {
 			err := serializeElementText(context, e)
 			if err != nil {
 				return err
@@ -156,7 +209,7 @@ func serializeElementText(context *serializerContext, element *DmElement) error
 
 	//writeTabs(context)
 	buf.WriteString("\"")
-	buf.WriteString(element.elementType)
+	textEscaper.WriteString(buf, element.elementType)
 	buf.WriteString("\"")
 	newLine(context)
 	writeTabs(context)
@@ -167,14 +220,14 @@ func serializeElementText(context *serializerContext, element *DmElement) error
 	if element.Name != "" {
 		writeTabs(context)
 		buf.WriteString("\"name\" \"string\" \"")
-		buf.WriteString(element.Name)
+		textEscaper.WriteString(buf, element.Name)
 		buf.WriteString("\"")
 		newLine(context)
 	}
 
 	writeTabs(context)
 	buf.WriteString("\"id\" \"elementid\" ")
-	uuid := fmt.Sprintf("\"%x-%x-%x-%x-%x\"", element.id[0:4], element.id[4:6], element.id[6:8], element.id[8:10], element.id[10:])
+	uuid := "\"" + FormatObjectId(element.id) + "\""
 	buf.WriteString(uuid)
 	newLine(context)
 
@@ -192,7 +245,7 @@ func serializeElementText(context *serializerContext, element *DmElement) error
 }
 
 func serializeAttributesText(context *serializerContext, element *DmElement) error {
-	for _, a := range element.attributes {
+	for _, a := range element.orderedAttributes {
 		err := serializeAttributeText(context, a)
 		if err != nil {
 			return err
@@ -217,8 +270,12 @@ func serializeArrayText(context *serializerContext, attribute *DmAttribute) erro
 			} else {
 				writeTabs(context)
 				buf.WriteString("\"element\" ")
-				uuid := fmt.Sprintf("\"%x-%x-%x-%x-%x\"", element.id[0:4], element.id[4:6], element.id[6:8], element.id[8:10], element.id[10:])
-				buf.WriteString(uuid)
+				if element == nil {
+					// Null entry loaded from a file
+					buf.WriteString("\"\"")
+				} else {
+					buf.WriteString("\"" + FormatObjectId(element.id) + "\"")
+				}
 				//buf.WriteString("\"")
 				//newLine(context)
 			}
@@ -233,13 +290,13 @@ func serializeArrayText(context *serializerContext, attribute *DmAttribute) erro
 		l := len(a)
 		for k, i := range a {
 			writeTabs(context)
-			buf.WriteString(strconv.FormatInt(int64(i), 10))
+			buf.WriteString("\"" + strconv.FormatInt(int64(i), 10) + "\"")
 			if k < l-1 {
 				buf.WriteString(",")
 			}
 			newLine(context)
 		}
-	case AT_FLOAT_ARRAY, AT_TIME_ARRAY:
+	case AT_FLOAT_ARRAY:
 		a := attribute.value.([]float32)
 		l := len(a)
 		for k, f := range a {
@@ -250,6 +307,17 @@ func serializeArrayText(context *serializerContext, attribute *DmAttribute) erro
 			}
 			newLine(context)
 		}
+	case AT_TIME_ARRAY:
+		a := attribute.value.([]DmTime)
+		l := len(a)
+		for k, t := range a {
+			writeTabs(context)
+			buf.WriteString("\"" + t.String() + "\"")
+			if k < l-1 {
+				buf.WriteString(",")
+			}
+			newLine(context)
+		}
 	case AT_BOOL_ARRAY:
 		a := attribute.value.([]bool)
 		l := len(a)
@@ -273,7 +341,20 @@ func serializeArrayText(context *serializerContext, attribute *DmAttribute) erro
 		for k, s := range a {
 			writeTabs(context)
 			buf.WriteString("\"")
-			buf.WriteString(s)
+			textEscaper.WriteString(buf, s)
+			buf.WriteString("\"")
+			if k < l-1 {
+				buf.WriteString(",")
+			}
+			newLine(context)
+		}
+	case AT_VOID_ARRAY:
+		a := attribute.value.([][]byte)
+		l := len(a)
+		for k, b := range a {
+			writeTabs(context)
+			buf.WriteString("\"")
+			buf.WriteString(strings.ToUpper(hex.EncodeToString(b)))
 			buf.WriteString("\"")
 			if k < l-1 {
 				buf.WriteString(",")
@@ -281,7 +362,7 @@ func serializeArrayText(context *serializerContext, attribute *DmAttribute) erro
 			newLine(context)
 		}
 	case AT_COLOR_ARRAY:
-		a := attribute.value.([][4]byte)
+		a := attribute.value.([]Color)
 		l := len(a)
 		for k, v := range a {
 			writeTabs(context)
@@ -345,12 +426,25 @@ func serializeArrayText(context *serializerContext, attribute *DmAttribute) erro
 			}
 			newLine(context)
 		}
+	case AT_VMATRIX_ARRAY:
+		a := attribute.value.([][16]float32)
+		l := len(a)
+		for k, v := range a {
+			writeTabs(context)
+			buf.WriteString("\"")
+			buf.WriteString(fmt.Sprintf("%g %g %g %g %g %g %g %g %g %g %g %g %g %g %g %g", v[0], v[1], v[2], v[3], v[4], v[5], v[6], v[7], v[8], v[9], v[10], v[11], v[12], v[13], v[14], v[15]))
+			buf.WriteString("\"")
+			if k < l-1 {
+				buf.WriteString(",")
+			}
+			newLine(context)
+		}
 	case AT_UINT64_ARRAY:
 		a := attribute.value.([]uint64)
 		l := len(a)
 		for k, i := range a {
 			writeTabs(context)
-			buf.WriteString(strconv.FormatUint(i, 10))
+			buf.WriteString("\"" + strconv.FormatUint(i, 10) + "\"")
 			if k < l-1 {
 				buf.WriteString(",")
 			}
@@ -381,7 +475,7 @@ func serializeAttributeText(context *serializerContext, attribute *DmAttribute)
 
 		writeTabs(context)
 		buf.WriteString("\"")
-		buf.WriteString(attribute.name)
+		textEscaper.WriteString(buf, attribute.name)
 		buf.WriteString("\" \"")
 		buf.WriteString(type_to_string[attribute.attributeType])
 		buf.WriteString("\"")
@@ -407,7 +501,7 @@ func serializeAttributeText(context *serializerContext, attribute *DmAttribute)
 			if shouldInlineElement(context, element) {
 				writeTabs(context)
 				buf.WriteString("\"")
-				buf.WriteString(attribute.name)
+				textEscaper.WriteString(buf, attribute.name)
 				buf.WriteString("\" ")
 				err := serializeElementText(context, attribute.value.(*DmElement))
 				if err != nil {
@@ -417,10 +511,10 @@ func serializeAttributeText(context *serializerContext, attribute *DmAttribute)
 			} else {
 				writeTabs(context)
 				buf.WriteString("\"")
-				buf.WriteString(attribute.name)
+				textEscaper.WriteString(buf, attribute.name)
 				buf.WriteString("\" \"element\" ")
 				if element != nil {
-					uuid := fmt.Sprintf("\"%x-%x-%x-%x-%x\"", element.id[0:4], element.id[4:6], element.id[6:8], element.id[8:10], element.id[10:])
+					uuid := "\"" + FormatObjectId(element.id) + "\""
 					buf.WriteString(uuid)
 				} else {
 					buf.WriteString("\"\"")
@@ -431,11 +525,11 @@ func serializeAttributeText(context *serializerContext, attribute *DmAttribute)
 		} else {
 			writeTabs(context)
 			buf.WriteString("\"")
-			buf.WriteString(attribute.name)
+			textEscaper.WriteString(buf, attribute.name)
 			buf.WriteString("\" \"")
 			buf.WriteString(type_to_string[attribute.attributeType])
 			buf.WriteString("\" \"")
-			buf.WriteString(attribute.StringValue())
+			textEscaper.WriteString(buf, attribute.StringValue())
 			buf.WriteString("\"")
 			newLine(context)
 		}
@@ -0,0 +1,81 @@
+package dmx
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type DmHeader struct {
+	Encoding        string
+	EncodingVersion int
+	Format          string
+	FormatVersion   int
+}
+
+func (header DmHeader) String() string {
+	return fmt.Sprintf("<!-- dmx encoding %s %d format %s %d -->", header.Encoding, header.EncodingVersion, header.Format, header.FormatVersion)
+}
+
+// Unserialize reads a dmx file of any supported encoding
+func Unserialize(r io.Reader) (*DmElement, DmHeader, error) {
+	document, err := UnserializeDocument(r)
+	if err != nil {
+		return nil, DmHeader{}, err
+	}
+	return document.Root, document.Header, nil
+}
+
+// UnserializeDocument reads a dmx file of any supported encoding along with its header and prefix attributes
+func UnserializeDocument(r io.Reader) (*DmDocument, error) {
+	reader := bufio.NewReader(r)
+
+	header, err := readHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var document *DmDocument
+	switch header.Encoding {
+	case "binary":
+		document, err = unserializeBinary(newUnserializerBinaryContext(reader, header.EncodingVersion))
+	case "keyvalues2":
+		document, err = unserializeText(newUnserializerTextContext(reader))
+	case "keyvalues2_flat":
+		context := newUnserializerTextContext(reader)
+		context.flat = true
+		document, err = unserializeText(context)
+	default:
+		return nil, errors.New("unsupported encoding " + header.Encoding)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	document.Header = header
+	return document, nil
+}
+
+func readHeader(reader *bufio.Reader) (DmHeader, error) {
+	var header DmHeader
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return header, errors.New("unable to read dmx header: " + err.Error())
+	}
+
+	if _, err := fmt.Sscanf(strings.TrimSpace(line), "<!-- dmx encoding %s %d format %s %d -->", &header.Encoding, &header.EncodingVersion, &header.Format, &header.FormatVersion); err != nil {
+		return header, errors.New("invalid dmx header: " + err.Error())
+	}
+
+	if header.Encoding == "binary" {
+		// Binary header is null terminated
+		if c, err := reader.ReadByte(); err != nil || c != 0 {
+			return header, errors.New("missing binary header terminator")
+		}
+	}
+
+	return header, nil
+}
@@ -0,0 +1,453 @@
+package dmx
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/baldurstod/go-vector"
+)
+
+type unserializerBinaryContext struct {
+	reader          *bufio.Reader
+	strings         []string
+	elements        []*DmElement
+	encodingVersion int
+	inlineStrings   bool // string values are read inline, for the prefix attributes
+}
+
+func newUnserializerBinaryContext(reader *bufio.Reader, encodingVersion int) *unserializerBinaryContext {
+	return &unserializerBinaryContext{
+		reader:          reader,
+		strings:         make([]string, 0, 1024),
+		elements:        make([]*DmElement, 0, 512),
+		encodingVersion: encodingVersion,
+	}
+}
+
+func UnserializeBinary(r io.Reader) (*DmElement, string, int, error) {
+	reader := bufio.NewReader(r)
+
+	header, err := readHeader(reader)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	if header.Encoding != "binary" {
+		return nil, "", 0, errors.New("unsupported encoding " + header.Encoding)
+	}
+
+	document, err := unserializeBinary(newUnserializerBinaryContext(reader, header.EncodingVersion))
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	return document.Root, header.Format, header.FormatVersion, nil
+}
+
+// unserializeBinary reads the elements, the first one is the root
+func unserializeBinary(context *unserializerBinaryContext) (*DmDocument, error) {
+	if err := checkBinaryEncodingVersion(context.encodingVersion); err != nil {
+		return nil, err
+	}
+
+	document := NewDmDocument(nil, DmHeader{})
+
+	if context.encodingVersion >= 9 {
+		if err := unserializePrefixBinary(context, document); err != nil {
+			return nil, err
+		}
+	}
+
+	if context.encodingVersion >= 2 {
+		if err := unserializeStringsBinary(context); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := unserializeDictBinary(context); err != nil {
+		return nil, err
+	}
+
+	document.elements = context.elements
+	if len(context.elements) > 0 {
+		document.Root = context.elements[0]
+	}
+	return document, nil
+}
+
+func unserializeStringsBinary(context *unserializerBinaryContext) error {
+	// The count is 16 bits before version 4
+	var count uint32
+	if context.encodingVersion < 4 {
+		c, err := readBinary[uint16](context)
+		if err != nil {
+			return err
+		}
+		count = uint32(c)
+	} else {
+		c, err := readBinary[uint32](context)
+		if err != nil {
+			return err
+		}
+		count = c
+	}
+
+	for i := uint32(0); i < count; i++ {
+		s, err := readStringBinary(context)
+		if err != nil {
+			return err
+		}
+		context.strings = append(context.strings, s)
+	}
+
+	return nil
+}
+
+func unserializeDictBinary(context *unserializerBinaryContext) error {
+	count, err := readBinary[uint32](context)
+	if err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		element, err := unserializeElementBinary(context)
+		if err != nil {
+			return err
+		}
+		context.elements = append(context.elements, element)
+	}
+
+	for _, e := range context.elements {
+		if err := unserializeAttributesBinary(context, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unserializeElementBinary(context *unserializerBinaryContext) (*DmElement, error) {
+	elementType, err := readSymbolBinary(context)
+	if err != nil {
+		return nil, err
+	}
+	name, err := readStringValueBinary(context)
+	if err != nil {
+		return nil, err
+	}
+	id, err := readBinary[DmObjectId](context)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDmElementWithId(name, elementType, id), nil
+}
+
+func unserializeAttributesBinary(context *unserializerBinaryContext, element *DmElement) error {
+	count, err := readBinary[uint32](context)
+	if err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		name, err := readSymbolBinary(context)
+		if err != nil {
+			return err
+		}
+		if err := unserializeAttributeBinary(context, element, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unserializeAttributeBinary reads the type and the value of the attribute name of element
+func unserializeAttributeBinary(context *unserializerBinaryContext, element *DmElement, name string) error {
+	typeId, err := readBinary[byte](context)
+	if err != nil {
+		return err
+	}
+	attributeType, err := attributeTypeFromBinary(typeId, context.encodingVersion)
+	if err != nil {
+		return err
+	}
+	if context.inlineStrings && (attributeType == AT_ELEMENT || attributeType == AT_ELEMENT_ARRAY) {
+		return errors.New("prefix attribute " + name + " can't reference elements")
+	}
+
+	value, err := unserializeAttributeValueBinary(context, attributeType)
+	if err != nil {
+		return err
+	}
+
+	attribute := element.CreateAttribute(name, attributeType)
+	if attribute == nil {
+		return errors.New("duplicate attribute " + name + " with a different type")
+	}
+	// The value is of the type used to store the attribute type, element arrays may contain null entries
+	attribute.value = value
+	return nil
+}
+
+// unserializePrefixBinary reads the prefix elements, their attributes are merged in the prefix of the document.
+// Attribute names and string values are inline since the string table is read after them.
+func unserializePrefixBinary(context *unserializerBinaryContext, document *DmDocument) error {
+	count, err := readBinary[uint32](context)
+	if err != nil {
+		return err
+	}
+
+	context.inlineStrings = true
+	defer func() { context.inlineStrings = false }()
+
+	for i := uint32(0); i < count; i++ {
+		attributeCount, err := readBinary[uint32](context)
+		if err != nil {
+			return err
+		}
+		for j := uint32(0); j < attributeCount; j++ {
+			name, err := readStringBinary(context)
+			if err != nil {
+				return err
+			}
+			if err := unserializeAttributeBinary(context, document.GetPrefix(), name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func unserializeAttributeValueBinary(context *unserializerBinaryContext, attributeType DmAttributeType) (interface{}, error) {
+	switch attributeType {
+	case AT_ELEMENT:
+		return unserializeElementAttribute(context)
+	case AT_INT:
+		return readBinary[int32](context)
+	case AT_FLOAT:
+		return readBinary[float32](context)
+	case AT_BOOL:
+		return readBinary[bool](context)
+	case AT_STRING:
+		return readStringValueBinary(context)
+	case AT_VOID:
+		return readBlobBinary(context)
+	case AT_TIME:
+		return readBinary[DmTime](context)
+	case AT_COLOR:
+		return readBinary[Color](context)
+	case AT_VECTOR2:
+		return readBinary[vector.Vector2[float32]](context)
+	case AT_VECTOR3, AT_QANGLE:
+		return readBinary[vector.Vector3[float32]](context)
+	case AT_VECTOR4:
+		return readBinary[vector.Vector4[float32]](context)
+	case AT_QUATERNION:
+		return readBinary[vector.Quaternion[float32]](context)
+	case AT_VMATRIX:
+		return readBinary[[16]float32](context)
+	case AT_UINT64:
+		return readBinary[uint64](context)
+	case AT_ELEMENT_ARRAY:
+		count, err := readBinary[uint32](context)
+		if err != nil {
+			return nil, err
+		}
+		a := make([]*DmElement, 0, min(count, 1024))
+		for i := uint32(0); i < count; i++ {
+			e, err := unserializeElementAttribute(context)
+			if err != nil {
+				return nil, err
+			}
+			// Null entries are kept to preserve the indices
+			a = append(a, e)
+		}
+		return a, nil
+	case AT_INT_ARRAY:
+		return unserializeArrayAttribute[int32](context)
+	case AT_FLOAT_ARRAY:
+		return unserializeArrayAttribute[float32](context)
+	case AT_BOOL_ARRAY:
+		return unserializeArrayAttribute[bool](context)
+	case AT_STRING_ARRAY:
+		return unserializeStringArrayAttribute(context)
+	case AT_VOID_ARRAY:
+		count, err := readBinary[uint32](context)
+		if err != nil {
+			return nil, err
+		}
+		a := make([][]byte, 0, min(count, 1024))
+		for i := uint32(0); i < count; i++ {
+			b, err := readBlobBinary(context)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, b)
+		}
+		return a, nil
+	case AT_TIME_ARRAY:
+		return unserializeArrayAttribute[DmTime](context)
+	case AT_COLOR_ARRAY:
+		return unserializeArrayAttribute[Color](context)
+	case AT_VECTOR2_ARRAY:
+		return unserializeArrayAttribute[vector.Vector2[float32]](context)
+	case AT_VECTOR3_ARRAY, AT_QANGLE_ARRAY:
+		return unserializeArrayAttribute[vector.Vector3[float32]](context)
+	case AT_VECTOR4_ARRAY:
+		return unserializeArrayAttribute[vector.Vector4[float32]](context)
+	case AT_QUATERNION_ARRAY:
+		return unserializeArrayAttribute[vector.Quaternion[float32]](context)
+	case AT_VMATRIX_ARRAY:
+		return unserializeArrayAttribute[[16]float32](context)
+	case AT_UINT64_ARRAY:
+		return unserializeArrayAttribute[uint64](context)
+	default:
+		return nil, errors.New("unknown attribute type " + strconv.Itoa(int(attributeType)))
+	}
+}
+
+func unserializeElementAttribute(context *unserializerBinaryContext) (*DmElement, error) {
+	index, err := readBinary[int32](context)
+	if err != nil {
+		return nil, err
+	}
+
+	switch index {
+	case -1:
+		return nil, nil
+	case -2:
+		// External element, referenced by an id string. It isn't part of the file and is read as a nil reference
+		if _, err := readStringBinary(context); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	if index < 0 || int(index) >= len(context.elements) {
+		return nil, errors.New("invalid element index " + strconv.Itoa(int(index)))
+	}
+
+	return context.elements[index], nil
+}
+
+func unserializeArrayAttribute[T int32 | float32 | DmTime | bool | Color | vector.Vector2[float32] | vector.Vector3[float32] | vector.Vector4[float32] | vector.Quaternion[float32] | [16]float32 | uint64](context *unserializerBinaryContext) ([]T, error) {
+	count, err := readBinary[uint32](context)
+	if err != nil {
+		return nil, err
+	}
+
+	// The count comes from the file, read in chunks to not allocate more than the actual data
+	a := make([]T, 0, min(count, 1024))
+	for remaining := count; remaining > 0; {
+		chunk := make([]T, min(remaining, 1024))
+		if err := binary.Read(context.reader, binary.LittleEndian, chunk); err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		a = append(a, chunk...)
+		remaining -= uint32(len(chunk))
+	}
+
+	return a, nil
+}
+
+func unserializeStringArrayAttribute(context *unserializerBinaryContext) ([]string, error) {
+	count, err := readBinary[uint32](context)
+	if err != nil {
+		return nil, err
+	}
+
+	a := make([]string, 0, min(count, 1024))
+	for i := uint32(0); i < count; i++ {
+		s, err := readStringBinary(context)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, s)
+	}
+
+	return a, nil
+}
+
+func readBinary[T any](context *unserializerBinaryContext) (T, error) {
+	var v T
+	err := binary.Read(context.reader, binary.LittleEndian, &v)
+	if err == io.EOF {
+		// All the reads are counted, the stream can't legitimately end here
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+// readBlobBinary reads a binary value prefixed by its length
+func readBlobBinary(context *unserializerBinaryContext) ([]byte, error) {
+	length, err := readBinary[uint32](context)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, min(length, 64*1024))
+	for remaining := int64(length); remaining > 0; {
+		chunk := make([]byte, min(remaining, 64*1024))
+		if _, err := io.ReadFull(context.reader, chunk); err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		b = append(b, chunk...)
+		remaining -= int64(len(chunk))
+	}
+	return b, nil
+}
+
+func readStringBinary(context *unserializerBinaryContext) (string, error) {
+	s, err := context.reader.ReadString(0)
+	if err != nil {
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return s[:len(s)-1], nil
+}
+
+// readSymbolBinary reads an element type or an attribute name
+func readSymbolBinary(context *unserializerBinaryContext) (string, error) {
+	if context.encodingVersion < 2 {
+		return readStringBinary(context)
+	}
+
+	var id uint32
+	if context.encodingVersion < 5 {
+		i, err := readBinary[uint16](context)
+		if err != nil {
+			return "", err
+		}
+		id = uint32(i)
+	} else {
+		i, err := readBinary[uint32](context)
+		if err != nil {
+			return "", err
+		}
+		id = i
+	}
+
+	if int(id) >= len(context.strings) {
+		return "", errors.New("invalid string index " + strconv.FormatUint(uint64(id), 10))
+	}
+
+	return context.strings[id], nil
+}
+
+// readStringValueBinary reads an element name or a string attribute value
+func readStringValueBinary(context *unserializerBinaryContext) (string, error) {
+	if context.encodingVersion < 4 || context.inlineStrings {
+		return readStringBinary(context)
+	}
+	return readSymbolBinary(context)
+}
@@ -0,0 +1,605 @@
+package dmx
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/baldurstod/go-vector"
+)
+
+type tokenizer struct {
+	reader *bufio.Reader
+	line   int
+}
+
+func newTokenizer(reader *bufio.Reader, line int) *tokenizer {
+	return &tokenizer{
+		reader: reader,
+		line:   line,
+	}
+}
+
+func (t *tokenizer) errorf(format string, a ...any) error {
+	return fmt.Errorf("line %d: %s", t.line, fmt.Sprintf(format, a...))
+}
+
+func (t *tokenizer) readByte() (byte, error) {
+	c, err := t.reader.ReadByte()
+	if err == nil && c == '\n' {
+		t.line++
+	}
+	return c, err
+}
+
+func (t *tokenizer) unreadByte(c byte) {
+	t.reader.UnreadByte()
+	if c == '\n' {
+		t.line--
+	}
+}
+
+func (t *tokenizer) skipWhitespacesAndComments() error {
+	for {
+		c, err := t.readByte()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			continue
+		case c == '/':
+			next, err := t.readByte()
+			if err != nil || next != '/' {
+				return t.errorf("unexpected character '/'")
+			}
+			if _, err := t.reader.ReadString('\n'); err != nil {
+				return err
+			}
+			t.line++
+		default:
+			t.unreadByte(c)
+			return nil
+		}
+	}
+}
+
+func (t *tokenizer) nextToken() (DmToken, string, error) {
+	if err := t.skipWhitespacesAndComments(); err != nil {
+		if err == io.EOF {
+			return TOKEN_EOF, "", nil
+		}
+		return TOKEN_INVALID, "", err
+	}
+
+	c, err := t.readByte()
+	if err != nil {
+		return TOKEN_INVALID, "", err
+	}
+
+	switch c {
+	case '{':
+		return TOKEN_OPEN_BRACE, "", nil
+	case '}':
+		return TOKEN_CLOSE_BRACE, "", nil
+	case '[':
+		return TOKEN_OPEN_BRACKET, "", nil
+	case ']':
+		return TOKEN_CLOSE_BRACKET, "", nil
+	case ',':
+		return TOKEN_COMMA, "", nil
+	case '"':
+		return t.readDelimitedString()
+	default:
+		t.unreadByte(c)
+		s, err := t.readWord()
+		if err != nil {
+			return TOKEN_INVALID, "", err
+		}
+		if s == "#include" {
+			return TOKEN_INCLUDE, s, nil
+		}
+		// Be lenient and accept non-quoted strings
+		return TOKEN_DELIMITED_STRING, s, nil
+	}
+}
+
+func (t *tokenizer) readDelimitedString() (DmToken, string, error) {
+	var sb strings.Builder
+	for {
+		c, err := t.readByte()
+		if err != nil {
+			if err == io.EOF {
+				return TOKEN_INVALID, "", t.errorf("unterminated string")
+			}
+			return TOKEN_INVALID, "", err
+		}
+
+		if c == '"' {
+			return TOKEN_DELIMITED_STRING, sb.String(), nil
+		}
+		if c == '\\' {
+			next, err := t.readByte()
+			if err != nil {
+				return TOKEN_INVALID, "", t.errorf("unterminated string")
+			}
+			if unescaped, exist := textEscapes[next]; exist {
+				sb.WriteByte(unescaped)
+				continue
+			}
+			// Not an escape sequence, like in a Windows path written without escaping
+			sb.WriteByte(c)
+			c = next
+		}
+		sb.WriteByte(c)
+	}
+}
+
+var textEscapes = map[byte]byte{
+	'n':  '\n',
+	't':  '\t',
+	'v':  '\v',
+	'b':  '\b',
+	'r':  '\r',
+	'f':  '\f',
+	'a':  '\a',
+	'\\': '\\',
+	'?':  '?',
+	'\'': '\'',
+	'"':  '"',
+}
+
+func (t *tokenizer) readWord() (string, error) {
+	var sb strings.Builder
+	for {
+		c, err := t.readByte()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", err
+		}
+
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '{' || c == '}' || c == '[' || c == ']' || c == ',' || c == '"' {
+			t.unreadByte(c)
+			break
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String(), nil
+}
+
+func (t *tokenizer) expectToken(expected DmToken) (string, error) {
+	token, s, err := t.nextToken()
+	if err != nil {
+		return "", err
+	}
+	if token != expected {
+		return "", t.errorf("unexpected token %d, expecting %d", token, expected)
+	}
+	return s, nil
+}
+
+type elementReference struct {
+	attribute *DmAttribute
+	index     int // -1 for AT_ELEMENT attributes
+	id        DmObjectId
+}
+
+type unserializerTextContext struct {
+	tokenizer  *tokenizer
+	elements   map[DmObjectId]*DmElement
+	loaded     []*DmElement // elements in reading order
+	references []elementReference
+	flat       bool
+}
+
+func newUnserializerTextContext(reader *bufio.Reader) *unserializerTextContext {
+	return &unserializerTextContext{
+		tokenizer:  newTokenizer(reader, 2), // line 1 is the header
+		elements:   make(map[DmObjectId]*DmElement),
+		loaded:     make([]*DmElement, 0, 512),
+		references: make([]elementReference, 0, 512),
+	}
+}
+
+func UnserializeText(r io.Reader) (*DmElement, string, int, error) {
+	reader := bufio.NewReader(r)
+
+	header, err := readHeader(reader)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	if header.Encoding != "keyvalues2" && header.Encoding != "keyvalues2_flat" {
+		return nil, "", 0, errors.New("unsupported encoding " + header.Encoding)
+	}
+
+	document, err := unserializeText(newUnserializerTextContext(reader))
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	return document.Root, header.Format, header.FormatVersion, nil
+}
+
+// UnserializeTextFlat reads a keyvalues2_flat file, inline elements are not allowed
+func UnserializeTextFlat(r io.Reader) (*DmElement, string, int, error) {
+	reader := bufio.NewReader(r)
+
+	header, err := readHeader(reader)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	if header.Encoding != "keyvalues2_flat" {
+		return nil, "", 0, errors.New("unsupported encoding " + header.Encoding)
+	}
+
+	context := newUnserializerTextContext(reader)
+	context.flat = true
+	document, err := unserializeText(context)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	return document.Root, header.Format, header.FormatVersion, nil
+}
+
+// unserializeText reads the top level elements, the first one is the root unless it holds the prefix attributes
+func unserializeText(context *unserializerTextContext) (*DmDocument, error) {
+	document := NewDmDocument(nil, DmHeader{})
+	t := context.tokenizer
+	first := true
+
+	for {
+		token, s, err := t.nextToken()
+		if err != nil {
+			return nil, err
+		}
+
+		switch token {
+		case TOKEN_EOF:
+			if err := resolveReferences(context); err != nil {
+				return nil, err
+			}
+			for _, e := range context.loaded {
+				if e != document.prefix {
+					document.elements = append(document.elements, e)
+				}
+			}
+			return document, nil
+		case TOKEN_DELIMITED_STRING:
+			element, err := unserializeElementText(context, s)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case first && element.elementType == PREFIX_ELEMENT_TYPE:
+				if err := checkPrefix(element); err != nil {
+					return nil, err
+				}
+				document.prefix = element
+			case document.Root == nil:
+				document.Root = element
+			}
+			first = false
+		case TOKEN_INCLUDE:
+			return nil, t.errorf("#include is not supported")
+		default:
+			return nil, t.errorf("unexpected token %d", token)
+		}
+	}
+}
+
+func resolveReferences(context *unserializerTextContext) error {
+	for _, ref := range context.references {
+		element, exist := context.elements[ref.id]
+		if !exist {
+			return errors.New("unresolved element reference " + FormatObjectId(ref.id) + " in attribute " + ref.attribute.name)
+		}
+
+		if ref.index < 0 {
+			ref.attribute.value = element
+		} else {
+			ref.attribute.value.([]*DmElement)[ref.index] = element
+		}
+	}
+	return nil
+}
+
+// unserializeElementText reads an element body, the element type has already been read
+func unserializeElementText(context *unserializerTextContext, elementType string) (*DmElement, error) {
+	t := context.tokenizer
+
+	if _, err := t.expectToken(TOKEN_OPEN_BRACE); err != nil {
+		return nil, err
+	}
+
+	// The id is read with the attributes
+	element := newDmElementWithId("", elementType, NilObjectId)
+	hasId := false
+
+	for {
+		token, name, err := t.nextToken()
+		if err != nil {
+			return nil, err
+		}
+
+		if token == TOKEN_CLOSE_BRACE {
+			break
+		}
+		if token != TOKEN_DELIMITED_STRING {
+			return nil, t.errorf("unexpected token %d, expecting attribute name", token)
+		}
+
+		typeName, err := t.expectToken(TOKEN_DELIMITED_STRING)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := unserializeAttributeText(context, element, name, typeName); err != nil {
+			return nil, err
+		}
+		hasId = hasId || typeName == "elementid"
+	}
+
+	if !hasId {
+		element.id = CreateObjectId()
+	}
+
+	if _, exist := context.elements[element.id]; exist {
+		return nil, t.errorf("duplicate element id %s", FormatObjectId(element.id))
+	}
+	context.elements[element.id] = element
+	context.loaded = append(context.loaded, element)
+
+	return element, nil
+}
+
+func unserializeAttributeText(context *unserializerTextContext, element *DmElement, name string, typeName string) error {
+	t := context.tokenizer
+
+	switch typeName {
+	case "elementid":
+		s, err := t.expectToken(TOKEN_DELIMITED_STRING)
+		if err != nil {
+			return err
+		}
+		if name != "id" {
+			return t.errorf("unexpected elementid attribute %s", name)
+		}
+		id, err := ParseObjectId(s)
+		if err != nil {
+			return t.errorf("%s", err)
+		}
+		element.id = id
+		return nil
+	case "element":
+		s, err := t.expectToken(TOKEN_DELIMITED_STRING)
+		if err != nil {
+			return err
+		}
+		attribute, err := createAttributeText(context, element, name, AT_ELEMENT)
+		if err != nil {
+			return err
+		}
+		if s == "" {
+			attribute.value = (*DmElement)(nil)
+			return nil
+		}
+		id, err := ParseObjectId(s)
+		if err != nil {
+			return t.errorf("%s", err)
+		}
+		context.references = append(context.references, elementReference{attribute: attribute, index: -1, id: id})
+		return nil
+	}
+
+	attributeType := typeFromString(typeName)
+	switch {
+	case attributeType == AT_UNKNOWN:
+		// Inline element
+		if context.flat {
+			return t.errorf("unexpected inline element %s in flat file", name)
+		}
+		child, err := unserializeElementText(context, typeName)
+		if err != nil {
+			return err
+		}
+		attribute, err := createAttributeText(context, element, name, AT_ELEMENT)
+		if err != nil {
+			return err
+		}
+		attribute.value = child
+	case attributeType >= AT_FIRST_ARRAY_TYPE:
+		attribute, err := createAttributeText(context, element, name, attributeType)
+		if err != nil {
+			return err
+		}
+		return unserializeArrayText(context, attribute)
+	default:
+		s, err := t.expectToken(TOKEN_DELIMITED_STRING)
+		if err != nil {
+			return err
+		}
+		if name == "name" && attributeType == AT_STRING {
+			element.Name = s
+			return nil
+		}
+		value, err := parseValueText(attributeType, s)
+		if err != nil {
+			return t.errorf("%s", err)
+		}
+		attribute, err := createAttributeText(context, element, name, attributeType)
+		if err != nil {
+			return err
+		}
+		attribute.value = value
+	}
+	return nil
+}
+
+// createAttributeText creates an attribute, duplicate names are rejected since pending references point to the first value
+func createAttributeText(context *unserializerTextContext, element *DmElement, name string, attributeType DmAttributeType) (*DmAttribute, error) {
+	if element.HasAttribute(name) {
+		return nil, context.tokenizer.errorf("duplicate attribute %s", name)
+	}
+	return element.CreateAttribute(name, attributeType), nil
+}
+
+func unserializeArrayText(context *unserializerTextContext, attribute *DmAttribute) error {
+	t := context.tokenizer
+
+	if _, err := t.expectToken(TOKEN_OPEN_BRACKET); err != nil {
+		return err
+	}
+
+	values := make([]interface{}, 0, 16)
+	for {
+		token, s, err := t.nextToken()
+		if err != nil {
+			return err
+		}
+
+		if token == TOKEN_CLOSE_BRACKET {
+			break
+		}
+		if len(values) > 0 {
+			if token != TOKEN_COMMA {
+				return t.errorf("unexpected token %d, expecting ','", token)
+			}
+			if token, s, err = t.nextToken(); err != nil {
+				return err
+			}
+		}
+		if token != TOKEN_DELIMITED_STRING {
+			return t.errorf("unexpected token %d, expecting array value", token)
+		}
+
+		if attribute.attributeType == AT_ELEMENT_ARRAY {
+			if s == "element" {
+				s, err := t.expectToken(TOKEN_DELIMITED_STRING)
+				if err != nil {
+					return err
+				}
+				if s == "" {
+					// An empty id is a nil reference, like in element attributes. It is kept to preserve the indices
+					values = append(values, (*DmElement)(nil))
+					continue
+				}
+				id, err := ParseObjectId(s)
+				if err != nil {
+					return t.errorf("%s", err)
+				}
+				context.references = append(context.references, elementReference{attribute: attribute, index: len(values), id: id})
+				values = append(values, (*DmElement)(nil))
+			} else {
+				if context.flat {
+					return t.errorf("unexpected inline element in flat file")
+				}
+				child, err := unserializeElementText(context, s)
+				if err != nil {
+					return err
+				}
+				values = append(values, child)
+			}
+		} else {
+			value, err := parseValueText(arrayItemType(attribute.attributeType), s)
+			if err != nil {
+				return t.errorf("%s", err)
+			}
+			values = append(values, value)
+		}
+	}
+
+	value, err := makeArray(attribute.attributeType, values)
+	if err != nil {
+		return t.errorf("%s", err)
+	}
+	attribute.value = value
+
+	return nil
+}
+
+func parseValueText(attributeType DmAttributeType, s string) (interface{}, error) {
+	switch attributeType {
+	case AT_INT:
+		i, err := strconv.ParseInt(s, 10, 32)
+		return int32(i), err
+	case AT_FLOAT:
+		f, err := strconv.ParseFloat(s, 32)
+		return float32(f), err
+	case AT_TIME:
+		return parseDmTime(s)
+	case AT_BOOL:
+		return strconv.ParseBool(s)
+	case AT_STRING:
+		return s, nil
+	case AT_VOID:
+		// Long values may be split on several lines
+		b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+		if err != nil {
+			return nil, errors.New("invalid binary value")
+		}
+		return b, nil
+	case AT_COLOR:
+		var c Color
+		fields := strings.Fields(s)
+		if len(fields) != 4 {
+			return nil, errors.New("invalid color value " + s)
+		}
+		for k, f := range fields {
+			i, err := strconv.ParseUint(f, 10, 8)
+			if err != nil {
+				return nil, err
+			}
+			c[k] = byte(i)
+		}
+		return c, nil
+	case AT_VECTOR2:
+		var v vector.Vector2[float32]
+		err := parseFloatsText(s, v[:])
+		return v, err
+	case AT_VECTOR3, AT_QANGLE:
+		var v vector.Vector3[float32]
+		err := parseFloatsText(s, v[:])
+		return v, err
+	case AT_VECTOR4:
+		var v vector.Vector4[float32]
+		err := parseFloatsText(s, v[:])
+		return v, err
+	case AT_QUATERNION:
+		var v vector.Quaternion[float32]
+		err := parseFloatsText(s, v[:])
+		return v, err
+	case AT_VMATRIX:
+		var v [16]float32
+		err := parseFloatsText(s, v[:])
+		return v, err
+	case AT_UINT64:
+		return strconv.ParseUint(s, 10, 64)
+	default:
+		return nil, errors.New("unsupported attribute type " + type_to_string[attributeType])
+	}
+}
+
+func parseFloatsText(s string, dest []float32) error {
+	fields := strings.Fields(s)
+	if len(fields) != len(dest) {
+		return fmt.Errorf("expecting %d values, got %d in %q", len(dest), len(fields), s)
+	}
+	for k, f := range fields {
+		v, err := strconv.ParseFloat(f, 32)
+		if err != nil {
+			return err
+		}
+		dest[k] = float32(v)
+	}
+	return nil
+}
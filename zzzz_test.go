@@ -2,12 +2,20 @@ package dmx_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
+	"image/color"
 	"log"
+	"math"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/baldurstod/go-dmx"
+	"github.com/baldurstod/go-vector"
 )
 
 func TestAttributesTypes(t *testing.T) {
@@ -67,7 +75,7 @@ func TestSerializeText(t *testing.T) {
 	root.CreateBoolAttribute("bool_attrib_false", false)
 	root.CreateBoolAttribute("bool_attrib_true", true)
 	root.CreateStringAttribute("string_attrib", "this is a string")
-	root.CreateTimeAttribute("time_attrib", 123)
+	root.CreateTimeAttribute("time_attrib", dmx.DmTimeFromSeconds(123))
 	root.CreateColorAttribute("color_attrib", [...]byte{1, 2, 3, 4})
 	root.CreateVector2Attribute("vec2_attrib", [...]float32{1.414, 3.14})
 	root.CreateVector3Attribute("vec3_attrib", [...]float32{1.23, 4.56, 7.89})
@@ -111,9 +119,9 @@ func TestSerializeText(t *testing.T) {
 	stringArray.PushString("this is string 3")
 
 	timeArray := root.CreateAttribute("time_array_attrib", dmx.AT_TIME_ARRAY)
-	timeArray.PushTime(1)
-	timeArray.PushTime(2)
-	timeArray.PushTime(3)
+	timeArray.PushTime(dmx.DmTimeFromSeconds(1))
+	timeArray.PushTime(dmx.DmTimeFromSeconds(2))
+	timeArray.PushTime(dmx.DmTimeFromSeconds(3))
 
 	colorArray := root.CreateAttribute("color_array_attrib", dmx.AT_COLOR_ARRAY)
 	colorArray.PushColor([...]byte{1, 2, 3, 4})
@@ -170,3 +178,1646 @@ func TestSerializeInlineText(t *testing.T) {
 	dmx.SerializeText(buf, root, "sfm_session", 22)
 	os.WriteFile(path.Join("./var/", "test_session.dmx"), buf.Bytes(), 0666)
 }
+
+func TestUnserializeText(t *testing.T) {
+	root := dmx.NewDmElement("test_DmElement", "DmElement")
+	root.CreateIntAttribute("int_attrib", 1234)
+	root.CreateFloatAttribute("float_attrib", 123.456)
+	root.CreateBoolAttribute("bool_attrib", true)
+	root.CreateStringAttribute("string_attrib", "this is a string")
+	root.CreateColorAttribute("color_attrib", [...]byte{1, 2, 3, 4})
+	root.CreateMatrixAttribute("matrix_attrib", [...]float32{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1})
+	root.CreateElementAttribute("inline_element", dmx.NewDmElement("inline_DmElement", "DmElement"))
+	elem := dmx.NewDmElement("shared_DmElement", "DmElement")
+	root.CreateElementAttribute("element_1", elem)
+	root.CreateElementAttribute("element_2", elem)
+	root.CreateElementAttribute("nil_element", nil)
+
+	elemArray := root.CreateAttribute("element_array_attrib", dmx.AT_ELEMENT_ARRAY)
+	elemArray.PushElement(dmx.NewDmElement("child_DmElement", "DmElement"))
+	elemArray.PushElement(elem)
+
+	intArray := root.CreateAttribute("int_array_attrib", dmx.AT_INT_ARRAY)
+	intArray.PushInt(1)
+	intArray.PushInt(2)
+	intArray.PushInt(3)
+
+	buf := new(bytes.Buffer)
+	if err := dmx.SerializeText(buf, root, "sfm_session", 22); err != nil {
+		t.Fatal(err)
+	}
+
+	root2, format, formatVersion, err := dmx.UnserializeText(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if format != "sfm_session" || formatVersion != 22 {
+		t.Error("wrong format", format, formatVersion)
+	}
+
+	if root2.Name != root.Name || root2.GetId() != root.GetId() {
+		t.Error("wrong root element")
+	}
+
+	if v := root2.CreateAttribute("int_attrib", dmx.AT_INT).GetValue(); v != int32(1234) {
+		t.Error("wrong int value", v)
+	}
+	if v := root2.CreateAttribute("float_attrib", dmx.AT_FLOAT).GetValue(); v != float32(123.456) {
+		t.Error("wrong float value", v)
+	}
+	if v := root2.CreateAttribute("color_attrib", dmx.AT_COLOR).GetValue(); v != dmx.NewColor(1, 2, 3, 4) {
+		t.Error("wrong color value", v)
+	}
+
+	inline := root2.CreateAttribute("inline_element", dmx.AT_ELEMENT).GetValue().(*dmx.DmElement)
+	if inline == nil || inline.Name != "inline_DmElement" {
+		t.Error("wrong inline element", inline)
+	}
+
+	e1 := root2.CreateAttribute("element_1", dmx.AT_ELEMENT).GetValue().(*dmx.DmElement)
+	e2 := root2.CreateAttribute("element_2", dmx.AT_ELEMENT).GetValue().(*dmx.DmElement)
+	if e1 == nil || e1 != e2 || e1.GetId() != elem.GetId() {
+		t.Error("shared element not resolved")
+	}
+
+	a := root2.CreateAttribute("element_array_attrib", dmx.AT_ELEMENT_ARRAY).GetValue().([]*dmx.DmElement)
+	if len(a) != 2 || a[1] != e1 {
+		t.Error("wrong element array", a)
+	}
+
+	i := root2.CreateAttribute("int_array_attrib", dmx.AT_INT_ARRAY).GetValue().([]int32)
+	if len(i) != 3 || i[2] != 3 {
+		t.Error("wrong int array", i)
+	}
+}
+
+func TestUnserializeHandEditedText(t *testing.T) {
+	const text = `<!-- dmx encoding keyvalues2 1 format model 1 -->
+// a comment
+"DmElement"
+{
+	"id" "elementid" "c4b5f5d1-2b8d-4b5a-9a0f-0a6c1e3f2b11"
+	"name" "string" "root"
+	"skeleton" "element" "0f8b1c2d-3e4f-4a5b-8c6d-7e8f9a0b1c2d" // forward reference
+	"positions" "vector3_array" [ "0 0 0", "1 2 3" ]
+}
+
+"DmeModel"
+{
+	"id" "elementid" "0f8b1c2d-3e4f-4a5b-8c6d-7e8f9a0b1c2d"
+	"name" "string" "skeleton"
+	"visible" "bool" "1"
+}
+`
+	root, _, _, err := dmx.UnserializeText(bytes.NewBufferString(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skeleton := root.CreateAttribute("skeleton", dmx.AT_ELEMENT).GetValue().(*dmx.DmElement)
+	if skeleton == nil || skeleton.Name != "skeleton" || skeleton.GetType() != "DmeModel" {
+		t.Error("wrong skeleton", skeleton)
+	}
+
+	if _, _, _, err := dmx.UnserializeText(bytes.NewBufferString(`<!-- dmx encoding keyvalues2 1 format model 1 -->
+"DmElement"
+{
+	"missing" "element" "0f8b1c2d-3e4f-4a5b-8c6d-7e8f9a0b1c2d"
+}
+`)); err == nil {
+		t.Error("unresolved reference should fail")
+	}
+
+	// Empty ids are nil references, they are kept in element arrays
+	root, _, _, err = dmx.UnserializeText(bytes.NewBufferString(`<!-- dmx encoding keyvalues2 1 format model 1 -->
+"DmElement"
+{
+	"nil_element" "element" ""
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := root.GetElement("nil_element"); err != nil || v != nil {
+		t.Error("wrong nil element", v, err)
+	}
+
+	root, _, _, err = dmx.UnserializeText(bytes.NewBufferString(`<!-- dmx encoding keyvalues2 1 format model 1 -->
+"DmElement"
+{
+	"children" "element_array" [ "element" "", "DmElement" { "name" "string" "child" } ]
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := root.GetElementArray("children"); len(v) != 2 || v[0] != nil || v[1] == nil || v[1].Name != "child" {
+		t.Error("wrong element array with a nil entry", v)
+	}
+
+	// Duplicate attributes are rejected, the pending references of the first one would be out of range
+	_, _, _, err = dmx.UnserializeText(bytes.NewBufferString(`<!-- dmx encoding keyvalues2 1 format model 1 -->
+"DmElement"
+{
+	"id" "elementid" "0f8b1c2d-3e4f-4a5b-8c6d-7e8f9a0b1c2d"
+	"arr" "element_array" [ "element" "0f8b1c2d-3e4f-4a5b-8c6d-7e8f9a0b1c2d" ]
+	"arr" "element_array" [ ]
+}
+`))
+	if err == nil || !strings.Contains(err.Error(), "duplicate attribute arr") {
+		t.Error("wrong error for duplicate attribute", err)
+	}
+}
+
+func TestUnserialize(t *testing.T) {
+	root := dmx.NewDmElement("test_DmElement", "DmElement")
+	root.CreateIntAttribute("int_attrib", 1234)
+
+	text := new(bytes.Buffer)
+	if err := dmx.SerializeText(text, root, "sfm_session", 22); err != nil {
+		t.Fatal(err)
+	}
+
+	binary := new(bytes.Buffer)
+	if err := dmx.SerializeBinary(binary, root, "model", 18); err != nil {
+		t.Fatal(err)
+	}
+
+	root2, header, err := dmx.Unserialize(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != (dmx.DmHeader{Encoding: "keyvalues2", EncodingVersion: 4, Format: "sfm_session", FormatVersion: 22}) {
+		t.Error("wrong header", header)
+	}
+	if root2.GetId() != root.GetId() {
+		t.Error("wrong root element")
+	}
+
+	root2, header, err = dmx.Unserialize(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != (dmx.DmHeader{Encoding: "binary", EncodingVersion: 9, Format: "model", FormatVersion: 18}) {
+		t.Error("wrong header", header)
+	}
+	if root2.GetId() != root.GetId() {
+		t.Error("wrong root element")
+	}
+
+	if _, _, err := dmx.Unserialize(bytes.NewBufferString("<!-- dmx encoding xml 1 format model 1 -->\n")); err == nil {
+		t.Error("unknown encoding should fail")
+	}
+	if _, _, err := dmx.Unserialize(bytes.NewBufferString("not a dmx file\n")); err == nil {
+		t.Error("invalid header should fail")
+	}
+}
+
+func TestSerializeTextFlat(t *testing.T) {
+	root := dmx.NewDmElement("test_DmElement", "DmElement")
+	clip := dmx.NewDmElement("test_DmeFilmClip", "DmeFilmClip")
+	timeFrame := dmx.NewDmElement("test_DmeTimeFrame", "DmeTimeFrame")
+
+	root.CreateElementAttribute("activeClip", clip)
+	elemArray := root.CreateAttribute("clipBin", dmx.AT_ELEMENT_ARRAY)
+	elemArray.PushElement(clip)
+	clip.CreateElementAttribute("timeFrame", timeFrame)
+	timeFrame.CreateTimeAttribute("duration", dmx.DmTimeFromSeconds(10))
+
+	buf := new(bytes.Buffer)
+	if err := dmx.SerializeTextFlat(buf, root, "sfm_session", 22); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Count(buf.Bytes(), []byte("\n{")) != 3 {
+		t.Error("all elements should be written at top level\n" + buf.String())
+	}
+
+	root2, format, _, err := dmx.UnserializeTextFlat(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "sfm_session" {
+		t.Error("wrong format", format)
+	}
+
+	clip2 := root2.CreateAttribute("activeClip", dmx.AT_ELEMENT).GetValue().(*dmx.DmElement)
+	if clip2 == nil || clip2.GetId() != clip.GetId() {
+		t.Error("wrong clip", clip2)
+	}
+	timeFrame2 := clip2.CreateAttribute("timeFrame", dmx.AT_ELEMENT).GetValue().(*dmx.DmElement)
+	if v := timeFrame2.CreateAttribute("duration", dmx.AT_TIME).GetValue(); v != dmx.DmTimeFromSeconds(10) {
+		t.Error("wrong duration", v)
+	}
+
+	if _, header, err := dmx.Unserialize(bytes.NewReader(buf.Bytes())); err != nil || header.Encoding != "keyvalues2_flat" {
+		t.Error("wrong header", header, err)
+	}
+
+	nested := new(bytes.Buffer)
+	if err := dmx.SerializeText(nested, root, "sfm_session", 22); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := dmx.UnserializeTextFlat(nested); err == nil {
+		t.Error("keyvalues2 file should not be accepted")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestSerializeTo(t *testing.T) {
+	root := dmx.NewDmElement("test_DmElement", "DmElement")
+	root.CreateStringAttribute("string_attrib", "this is a string")
+
+	compressed := new(bytes.Buffer)
+	gz := gzip.NewWriter(compressed)
+	if err := dmx.SerializeBinaryTo(gz, root, 9, "model", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gzr, err := gzip.NewReader(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root2, _, err := dmx.Unserialize(gzr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root2.GetId() != root.GetId() {
+		t.Error("wrong root element")
+	}
+
+	if err := dmx.SerializeTextTo(failingWriter{}, root, "model", 1); err == nil {
+		t.Error("write error should be reported")
+	}
+	if err := dmx.SerializeTextFlatTo(failingWriter{}, root, "model", 1); err == nil {
+		t.Error("write error should be reported")
+	}
+	if err := dmx.SerializeBinaryTo(failingWriter{}, root, 5, "model", 1); err == nil {
+		t.Error("write error should be reported")
+	}
+}
+
+func TestDeterministicSerialization(t *testing.T) {
+	root := dmx.NewDmElement("test_DmElement", "DmElement")
+	for i := 0; i < 20; i++ {
+		child := dmx.NewDmElement("child_"+strconv.Itoa(i), "DmElement")
+		child.CreateIntAttribute("int_attrib", int32(i))
+		child.CreateStringAttribute("string_attrib", "string "+strconv.Itoa(i))
+		root.CreateElementAttribute("child_"+strconv.Itoa(i), child)
+		root.CreateElementAttribute("shared_child_"+strconv.Itoa(i), child)
+	}
+
+	serializers := map[string]func(*bytes.Buffer, *dmx.DmElement, string, int) error{
+		"binary":          dmx.SerializeBinary,
+		"keyvalues2":      dmx.SerializeText,
+		"keyvalues2_flat": dmx.SerializeTextFlat,
+	}
+
+	for name, serialize := range serializers {
+		buf1 := new(bytes.Buffer)
+		if err := serialize(buf1, root, "model", 1); err != nil {
+			t.Fatal(name, err)
+		}
+		buf2 := new(bytes.Buffer)
+		if err := serialize(buf2, root, "model", 1); err != nil {
+			t.Fatal(name, err)
+		}
+		if !bytes.Equal(buf1.Bytes(), buf2.Bytes()) {
+			t.Error(name, "output is not deterministic")
+		}
+
+		root2, _, err := dmx.Unserialize(bytes.NewReader(buf1.Bytes()))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		buf3 := new(bytes.Buffer)
+		if err := serialize(buf3, root2, "model", 1); err != nil {
+			t.Fatal(name, err)
+		}
+		if !bytes.Equal(buf1.Bytes(), buf3.Bytes()) {
+			t.Error(name, "round trip changed the output")
+		}
+	}
+}
+
+func TestTypedAccessors(t *testing.T) {
+	element := dmx.NewDmElement("test_DmElement", "DmElement")
+	element.CreateIntAttribute("int_attrib", 1234)
+	element.CreateVector3Attribute("vec3_attrib", [...]float32{1, 2, 3})
+	element.CreateQAngleAttribute("qangle_attrib", [...]float32{0, 90, 0})
+	element.CreateAttribute("element_attrib", dmx.AT_ELEMENT)
+	elemArray := element.CreateAttribute("element_array_attrib", dmx.AT_ELEMENT_ARRAY)
+	elemArray.PushElement(dmx.NewDmElement("child", "DmElement"))
+
+	if v, err := element.GetInt("int_attrib"); err != nil || v != 1234 {
+		t.Error("GetInt failed", v, err)
+	}
+	if v, err := element.GetVector3("vec3_attrib"); err != nil || v != [...]float32{1, 2, 3} {
+		t.Error("GetVector3 failed", v, err)
+	}
+	if _, err := element.GetVector3("qangle_attrib"); err == nil {
+		t.Error("GetVector3 should fail on a qangle attribute")
+	}
+	if _, err := element.GetFloat("int_attrib"); err == nil {
+		t.Error("GetFloat should fail on an int attribute")
+	}
+	if _, err := element.GetInt("missing"); err == nil {
+		t.Error("GetInt should fail on a missing attribute")
+	}
+	if v, err := element.GetElement("element_attrib"); err != nil || v != nil {
+		t.Error("GetElement failed", v, err)
+	}
+	if v, err := element.GetElementArray("element_array_attrib"); err != nil || len(v) != 1 {
+		t.Error("GetElementArray failed", v, err)
+	}
+
+	attribute := element.CreateAttribute("int_attrib", dmx.AT_INT)
+	if err := dmx.Set(attribute, int32(5)); err != nil {
+		t.Error(err)
+	}
+	if v, err := dmx.Get[int32](attribute); err != nil || v != 5 {
+		t.Error("Get failed", v, err)
+	}
+	if err := dmx.Set(attribute, 5); err == nil {
+		t.Error("Set should fail with an int value")
+	}
+	if _, err := dmx.Get[float32](attribute); err == nil {
+		t.Error("Get should fail with a float32 type")
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	element := dmx.NewDmElement("test_DmElement", "DmElement")
+
+	intAttribute := element.CreateAttribute("int_attrib", dmx.AT_INT)
+	if err := intAttribute.SetValue(1234); err == nil {
+		t.Error("int should not be accepted by an int attribute")
+	}
+	if err := intAttribute.SetValue(int32(1234)); err != nil {
+		t.Error(err)
+	}
+	if err := intAttribute.SetValueLenient(4321); err != nil || intAttribute.GetValue() != int32(4321) {
+		t.Error("lenient int failed", intAttribute.GetValue(), err)
+	}
+	if err := intAttribute.SetValueLenient(int64(1) << 40); err == nil {
+		t.Error("out of range value should fail")
+	}
+	if err := intAttribute.SetValueLenient(1.5); err == nil {
+		t.Error("non integer value should fail")
+	}
+
+	elementAttribute := element.CreateAttribute("element_attrib", dmx.AT_ELEMENT)
+	if err := elementAttribute.SetValue(nil); err != nil {
+		t.Error(err)
+	}
+	if v, err := element.GetElement("element_attrib"); err != nil || v != nil {
+		t.Error("nil element failed", v, err)
+	}
+
+	vec3Attribute := element.CreateAttribute("vec3_attrib", dmx.AT_VECTOR3)
+	if err := vec3Attribute.SetValue([3]float32{1, 2, 3}); err == nil {
+		t.Error("[3]float32 should not be accepted by a vector3 attribute")
+	}
+	if err := vec3Attribute.SetValueLenient([]float64{1, 2, 3}); err != nil {
+		t.Error(err)
+	}
+	if v, _ := element.GetVector3("vec3_attrib"); v != [...]float32{1, 2, 3} {
+		t.Error("lenient vector3 failed", v)
+	}
+	if err := vec3Attribute.SetValueLenient([]float64{1, 2}); err == nil {
+		t.Error("wrong vector length should fail")
+	}
+
+	floatArray := element.CreateAttribute("float_array_attrib", dmx.AT_FLOAT_ARRAY)
+	if err := floatArray.SetValues(float32(1), float32(2)); err != nil {
+		t.Error(err)
+	}
+	if err := floatArray.SetValues(float32(1), 2.0); err == nil {
+		t.Error("float64 should not be accepted by a float array attribute")
+	}
+	if err := floatArray.SetValueLenient([]float64{1, 2, 3}); err != nil {
+		t.Error(err)
+	}
+	if v, _ := element.GetFloatArray("float_array_attrib"); len(v) != 3 || v[2] != 3 {
+		t.Error("lenient float array failed", v)
+	}
+
+	colorArray := element.CreateAttribute("color_array_attrib", dmx.AT_COLOR_ARRAY)
+	if err := colorArray.SetValuesLenient([]int{255, 0, 0, 255}, [4]uint8{0, 255, 0, 255}); err != nil {
+		t.Error(err)
+	}
+	if err := colorArray.SetValuesLenient([]int{256, 0, 0, 255}); err == nil {
+		t.Error("out of range color should fail")
+	}
+
+	elementArray := element.CreateAttribute("element_array_attrib", dmx.AT_ELEMENT_ARRAY)
+	if err := elementArray.SetValues(dmx.NewDmElement("child", "DmElement"), nil); err == nil {
+		t.Error("nil element should not be accepted in an element array")
+	}
+
+	if err := intAttribute.SetValues(int32(1)); err == nil {
+		t.Error("SetValues should fail on a non array attribute")
+	}
+}
+
+func TestAttributeEdition(t *testing.T) {
+	element := dmx.NewDmElement("test_DmElement", "DmElement")
+	element.CreateIntAttribute("a", 1)
+	element.CreateIntAttribute("b", 2)
+	element.CreateIntAttribute("c", 3)
+
+	if !element.HasAttribute("b") || element.GetAttribute("b") == nil {
+		t.Error("attribute b should exist")
+	}
+	if element.HasAttribute("d") || element.GetAttribute("d") != nil {
+		t.Error("attribute d should not exist")
+	}
+
+	if err := element.RenameAttribute("b", "renamed"); err != nil {
+		t.Error(err)
+	}
+	if element.HasAttribute("b") || element.GetAttribute("renamed").GetName() != "renamed" {
+		t.Error("rename failed")
+	}
+	if err := element.RenameAttribute("renamed", "c"); err == nil {
+		t.Error("rename to an existing name should fail")
+	}
+	if err := element.GetAttribute("c").SetName("d"); err != nil || element.HasAttribute("c") || !element.HasAttribute("d") {
+		t.Error("SetName should rename the attribute in its owner", err)
+	}
+
+	removed := element.RemoveAttribute("a")
+	if removed == nil || removed.GetOwner() != nil || element.HasAttribute("a") {
+		t.Error("remove failed")
+	}
+	if element.RemoveAttribute("a") != nil {
+		t.Error("second remove should return nil")
+	}
+	if a := element.CreateAttribute("a", dmx.AT_STRING); a == nil {
+		t.Error("a new attribute a should be creatable")
+	}
+
+	buf := new(bytes.Buffer)
+	if err := dmx.SerializeText(buf, element, "model", 1); err != nil {
+		t.Fatal(err)
+	}
+	text := buf.String()
+	if i, j, k := strings.Index(text, `"renamed"`), strings.Index(text, `"d"`), strings.Index(text, `"a"`); i < 0 || i > j || j > k {
+		t.Error("wrong attribute order\n" + text)
+	}
+
+	if err := element.ChangeAttributeType("renamed", dmx.AT_FLOAT); err != nil {
+		t.Error(err)
+	}
+	if v, err := element.GetFloat("renamed"); err != nil || v != 2 {
+		t.Error("int to float failed", v, err)
+	}
+	if err := element.ChangeAttributeType("renamed", dmx.AT_STRING); err != nil {
+		t.Error(err)
+	}
+	if v, err := element.GetString("renamed"); err != nil || v != "2" {
+		t.Error("float to string failed", v, err)
+	}
+	if err := element.ChangeAttributeType("renamed", dmx.AT_INT_ARRAY); err != nil {
+		t.Error(err)
+	}
+	if v, err := element.GetIntArray("renamed"); err != nil || len(v) != 1 || v[0] != 2 {
+		t.Error("string to int array failed", v, err)
+	}
+	if err := element.ChangeAttributeType("renamed", dmx.AT_VECTOR3); err == nil {
+		t.Error("array to vector3 should fail")
+	}
+
+	element.CreateVector3Attribute("angles", [...]float32{0, 90, 0})
+	if err := element.ChangeAttributeType("angles", dmx.AT_QANGLE); err != nil {
+		t.Error(err)
+	}
+	if v, err := element.GetQAngle("angles"); err != nil || v != [...]float32{0, 90, 0} {
+		t.Error("vector3 to qangle failed", v, err)
+	}
+}
+
+func TestIteration(t *testing.T) {
+	root := dmx.NewDmElement("root", "DmElement")
+	a := dmx.NewDmElement("a", "DmElement")
+	b := dmx.NewDmElement("b", "DmElement")
+	c := dmx.NewDmElement("c", "DmElement")
+	d := dmx.NewDmElement("d", "DmElement")
+
+	root.CreateElementAttribute("a", a)
+	root.CreateIntAttribute("int_attrib", 1)
+	children := root.CreateAttribute("children", dmx.AT_ELEMENT_ARRAY)
+	children.PushElement(b)
+	children.PushElement(a)
+	a.CreateElementAttribute("c", c)
+	b.CreateElementAttribute("d", d)
+	c.CreateElementAttribute("root", root) // cycle
+
+	names := make([]string, 0)
+	for name, attribute := range root.Attributes() {
+		if name != attribute.GetName() {
+			t.Error("wrong attribute name", name)
+		}
+		names = append(names, name)
+	}
+	if strings.Join(names, ",") != "a,int_attrib,children" || root.AttributeCount() != 3 {
+		t.Error("wrong attribute order", names)
+	}
+
+	visit := func(seq func(func(int, *dmx.DmElement) bool)) string {
+		visited := make([]string, 0)
+		for depth, e := range seq {
+			visited = append(visited, e.Name+strconv.Itoa(depth))
+		}
+		return strings.Join(visited, ",")
+	}
+
+	if v := visit(dmx.DepthFirst(root)); v != "root0,a1,c2,b1,d2" {
+		t.Error("wrong depth first order", v)
+	}
+	if v := visit(dmx.BreadthFirst(root)); v != "root0,a1,b1,c2,d2" {
+		t.Error("wrong breadth first order", v)
+	}
+
+	for _, e := range dmx.DepthFirst(root) {
+		if e == a {
+			break
+		}
+	}
+
+	counts := dmx.ReferenceCounts(root)
+	if counts[root] != 2 || counts[a] != 2 || counts[b] != 1 || counts[d] != 1 {
+		t.Error("wrong reference counts", counts)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	root := dmx.NewDmElement("root", "DmElement")
+	shared := dmx.NewDmElement("shared", "DmeOld")
+	removed := dmx.NewDmElement("removed", "DmeRemoved")
+	replaced := dmx.NewDmElement("replaced", "DmeReplaced")
+	replacement := dmx.NewDmElement("replacement", "DmElement")
+
+	root.CreateElementAttribute("shared_1", shared)
+	root.CreateElementAttribute("removed", removed)
+	root.CreateElementAttribute("replaced", replaced)
+	root.CreateStringAttribute("editor_data", "dropped")
+	version := root.CreateIntAttribute("version", 1)
+	weights := root.CreateAttribute("weights", dmx.AT_FLOAT_ARRAY)
+	weights.SetValue([]float32{1, 2})
+	root.CreateAttribute("untouched", dmx.AT_FLOAT_ARRAY).SetValue([]float32{1, 2})
+	children := root.CreateAttribute("children", dmx.AT_ELEMENT_ARRAY)
+	children.PushElement(shared)
+	children.PushElement(removed)
+	children.PushElement(replaced)
+	shared.CreateElementAttribute("parent", root) // cycle
+	shared.CreateStringAttribute("editor_data", "dropped")
+
+	visited := 0
+	if err := dmx.Visit(root, dmx.VisitFuncs{Element: func(*dmx.DmElement) error { visited++; return nil }}); err != nil || visited != 4 {
+		t.Error("wrong visit", visited, err)
+	}
+
+	newRoot, report, err := dmx.Transform(root, dmx.TransformFuncs{
+		Element: func(e *dmx.DmElement) (*dmx.DmElement, error) {
+			switch e.GetType() {
+			case "DmeOld":
+				e.SetType("DmeNew")
+			case "DmeRemoved":
+				return nil, nil
+			case "DmeReplaced":
+				return replacement, nil
+			}
+			return e, nil
+		},
+		Attribute: func(a *dmx.DmAttribute) (bool, error) {
+			switch a.GetName() {
+			case "version":
+				return true, a.SetValue(int32(2))
+			case "weights":
+				a.PushFloat(3)
+			}
+			return a.GetName() != "editor_data", nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newRoot != root {
+		t.Error("root should be kept")
+	}
+
+	if shared.GetType() != "DmeNew" {
+		t.Error("element type not replaced")
+	}
+	if root.HasAttribute("editor_data") || shared.HasAttribute("editor_data") {
+		t.Error("attributes not dropped")
+	}
+	if v, _ := root.GetElement("removed"); v != nil {
+		t.Error("removed element still referenced")
+	}
+	if v, _ := root.GetElement("replaced"); v != replacement {
+		t.Error("element not replaced")
+	}
+	if v, _ := root.GetElementArray("children"); len(v) != 2 || v[0] != shared || v[1] != replacement {
+		t.Error("wrong children", v)
+	}
+	kinds := make(map[dmx.TransformChangeKind]int)
+	for _, change := range report.Changes {
+		kinds[change.Kind]++
+		if change.Kind == dmx.CHANGE_ELEMENT_MODIFIED && change.Element != shared ||
+			change.Kind == dmx.CHANGE_ATTRIBUTE_MODIFIED && (change.Element != root || change.Attribute != version && change.Attribute != weights) {
+			t.Error("wrong change", change)
+		}
+	}
+	if len(report.Changes) != 7 || kinds[dmx.CHANGE_ATTRIBUTE_REMOVED] != 2 || kinds[dmx.CHANGE_ELEMENT_MODIFIED] != 1 || kinds[dmx.CHANGE_ATTRIBUTE_MODIFIED] != 2 {
+		t.Error("wrong changes", report.Changes)
+	}
+
+	newRoot, _, err = dmx.Transform(root, dmx.TransformFuncs{
+		Element: func(e *dmx.DmElement) (*dmx.DmElement, error) {
+			if e == root {
+				return nil, nil
+			}
+			return e, nil
+		},
+	})
+	if err != nil || newRoot != nil {
+		t.Error("root should be removed", newRoot, err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	root := dmx.NewDmElement("root", "DmeModel")
+	shared := dmx.NewDmElement("shared", "DmElement")
+	root.CreateElementAttribute("shared_1", shared)
+	root.CreateElementAttribute("shared_2", shared)
+	root.CreateElementAttribute("nil_element", nil)
+	shared.CreateElementAttribute("parent", root) // cycle
+	floatArray := root.CreateAttribute("float_array_attrib", dmx.AT_FLOAT_ARRAY)
+	floatArray.PushFloat(1)
+	floatArray.PushFloat(2)
+
+	clone, ids := dmx.Clone(root, dmx.CloneOptions{})
+	if clone == root || clone.Name != "root" || clone.GetType() != "DmeModel" {
+		t.Fatal("wrong clone")
+	}
+	if clone.GetId() == root.GetId() || ids[root.GetId()] != clone.GetId() || len(ids) != 2 {
+		t.Error("wrong ids", ids)
+	}
+
+	shared1, _ := clone.GetElement("shared_1")
+	shared2, _ := clone.GetElement("shared_2")
+	if shared1 == shared || shared1 != shared2 || ids[shared.GetId()] != shared1.GetId() {
+		t.Error("sharing not preserved")
+	}
+	if parent, _ := shared1.GetElement("parent"); parent != clone {
+		t.Error("cycle not preserved")
+	}
+	if v, err := clone.GetElement("nil_element"); err != nil || v != nil {
+		t.Error("nil element not preserved")
+	}
+
+	clone.GetAttribute("float_array_attrib").GetValue().([]float32)[0] = 10
+	if v, _ := root.GetFloatArray("float_array_attrib"); v[0] != 1 {
+		t.Error("array is aliased")
+	}
+
+	names := make([]string, 0)
+	for name := range clone.Attributes() {
+		names = append(names, name)
+	}
+	if strings.Join(names, ",") != "shared_1,shared_2,nil_element,float_array_attrib" {
+		t.Error("wrong attribute order", names)
+	}
+
+	clone, ids = dmx.Clone(root, dmx.CloneOptions{PreserveIds: true})
+	if clone.GetId() != root.GetId() || ids[root.GetId()] != root.GetId() {
+		t.Error("ids not preserved")
+	}
+}
+
+func TestEqualAndDiff(t *testing.T) {
+	root := dmx.NewDmElement("root", "DmeModel")
+	child := dmx.NewDmElement("child", "DmeDag")
+	root.CreateElementAttribute("child", child)
+	root.CreateFloatAttribute("scale", 1)
+	root.CreateStringAttribute("comment", "v1")
+	child.CreateVector3Attribute("position", [...]float32{1, 2, 3})
+	child.CreateElementAttribute("parent", root)
+
+	clone, _ := dmx.Clone(root, dmx.CloneOptions{})
+	if !dmx.Equal(root, clone, dmx.CompareOptions{}) {
+		t.Error("clone should be equal")
+	}
+	if dmx.Equal(root, clone, dmx.CompareOptions{CompareIds: true}) {
+		t.Error("clone with new ids should not be equal when comparing ids")
+	}
+
+	clone.GetAttribute("scale").SetValue(float32(1.0001))
+	if dmx.Equal(root, clone, dmx.CompareOptions{}) {
+		t.Error("graphs should differ")
+	}
+	if !dmx.Equal(root, clone, dmx.CompareOptions{FloatTolerance: 0.001}) {
+		t.Error("graphs should be equal with a tolerance")
+	}
+	if d := dmx.Diff(root, clone, dmx.CompareOptions{FloatTolerance: 0.001}); len(d) != 0 {
+		t.Error("no difference expected", d)
+	}
+
+	// Match by id
+	modified, _ := dmx.Clone(root, dmx.CloneOptions{PreserveIds: true})
+	modified.RemoveAttribute("comment")
+	modified.CreateIntAttribute("version", 2)
+	modifiedChild, _ := modified.GetElement("child")
+	modifiedChild.Name = "renamed"
+	modifiedChild.GetAttribute("position").SetValue(vector.Vector3[float32]{1, 2, 4})
+	added := dmx.NewDmElement("added", "DmeDag")
+	modified.CreateElementAttribute("added", added)
+
+	kinds := func(differences []dmx.Difference) string {
+		s := make([]string, 0)
+		for _, d := range differences {
+			s = append(s, d.Kind.String()+" "+d.Path+" "+d.Attribute)
+		}
+		return strings.Join(s, ",")
+	}
+
+	if d := kinds(dmx.Diff(root, modified, dmx.CompareOptions{})); d != "attribute removed root comment,attribute added root version,attribute added root added,element renamed root.child ,attribute changed root.child position,element added root.added " {
+		t.Error("wrong differences", d)
+	}
+
+	// Match by path
+	clone.RemoveAttribute("child")
+	if d := kinds(dmx.Diff(root, clone, dmx.CompareOptions{FloatTolerance: 0.001})); d != "attribute removed root child,element removed root.child " {
+		t.Error("wrong differences", d)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := dmx.NewDmElement("session", "DmElement")
+	clip := dmx.NewDmElement("clip", "DmeFilmClip")
+	base.CreateElementAttribute("activeClip", clip)
+	base.CreateIntAttribute("frameRate", 24)
+	base.CreateStringAttribute("comment", "base")
+	clips := base.CreateAttribute("clipBin", dmx.AT_ELEMENT_ARRAY)
+	clips.PushElement(clip)
+	removedClip := dmx.NewDmElement("removed", "DmeFilmClip")
+	clips.PushElement(removedClip)
+	clip.CreateFloatAttribute("duration", 10)
+
+	ours, _ := dmx.Clone(base, dmx.CloneOptions{PreserveIds: true})
+	theirs, _ := dmx.Clone(base, dmx.CloneOptions{PreserveIds: true})
+
+	// Ours
+	ours.GetAttribute("frameRate").SetValue(int32(30))
+	ours.GetAttribute("comment").SetValue("ours")
+	ourClip := dmx.NewDmElement("our clip", "DmeFilmClip")
+	ours.GetAttribute("clipBin").PushElement(ourClip)
+
+	// Theirs
+	theirs.GetAttribute("comment").SetValue("theirs")
+	theirClip := dmx.NewDmElement("their clip", "DmeFilmClip")
+	theirClip.CreateFloatAttribute("duration", 5)
+	theirs.GetAttribute("clipBin").SetValue([]*dmx.DmElement{theirs.GetAttribute("clipBin").GetValue().([]*dmx.DmElement)[0], theirClip})
+	theirActiveClip, _ := theirs.GetElement("activeClip")
+	theirActiveClip.GetAttribute("duration").SetValue(float32(20))
+	theirs.CreateBoolAttribute("locked", true)
+
+	merged, conflicts := dmx.Merge(base, ours, theirs)
+
+	if len(conflicts) != 1 || conflicts[0].Kind != dmx.CONFLICT_ATTRIBUTE || conflicts[0].Attribute != "comment" || conflicts[0].Theirs != "theirs" {
+		t.Error("wrong conflicts", conflicts)
+	}
+	if v, _ := merged.GetString("comment"); v != "ours" {
+		t.Error("conflict should keep our value", v)
+	}
+	if v, _ := merged.GetInt("frameRate"); v != 30 {
+		t.Error("wrong frame rate", v)
+	}
+	if v, _ := merged.GetBool("locked"); !v {
+		t.Error("added attribute not merged")
+	}
+	activeClip, _ := merged.GetElement("activeClip")
+	if v, _ := activeClip.GetFloat("duration"); v != 20 {
+		t.Error("nested change not merged", v)
+	}
+
+	names := make([]string, 0)
+	bin, _ := merged.GetElementArray("clipBin")
+	for _, c := range bin {
+		names = append(names, c.Name)
+	}
+	if strings.Join(names, ",") != "clip,our clip,their clip" || bin[0] != activeClip {
+		t.Error("wrong merged array", names)
+	}
+	if v, _ := bin[2].GetFloat("duration"); v != 5 || bin[2].GetId() != theirClip.GetId() {
+		t.Error("added element not copied")
+	}
+
+	if ours.GetAttribute("locked") != nil {
+		t.Error("ours should not be modified")
+	}
+}
+
+func TestMergeReorder(t *testing.T) {
+	base := dmx.NewDmElement("root", "DmElement")
+	children := base.CreateAttribute("children", dmx.AT_ELEMENT_ARRAY)
+	for _, name := range []string{"a", "b", "c"} {
+		children.PushElement(dmx.NewDmElement(name, "DmElement"))
+	}
+
+	theirs, _ := dmx.Clone(base, dmx.CloneOptions{PreserveIds: true})
+	c, _ := theirs.GetElementArray("children")
+	c[0], c[2] = c[2], c[0]
+
+	names := func(root *dmx.DmElement) string {
+		a := make([]string, 0)
+		children, _ := root.GetElementArray("children")
+		for _, e := range children {
+			a = append(a, e.Name)
+		}
+		return strings.Join(a, ",")
+	}
+
+	// Ours changed the members of the array, their order is kept
+	ours, _ := dmx.Clone(base, dmx.CloneOptions{PreserveIds: true})
+	ours.GetAttribute("children").PushElement(dmx.NewDmElement("d", "DmElement"))
+	ours.GetAttribute("children").RemoveAt(1)
+	merged, conflicts := dmx.Merge(base, ours, theirs)
+	if len(conflicts) != 0 || names(merged) != "c,a,d" {
+		t.Error("wrong merged order", names(merged), conflicts)
+	}
+
+	// Both sides reordered differently
+	ours, _ = dmx.Clone(base, dmx.CloneOptions{PreserveIds: true})
+	c, _ = ours.GetElementArray("children")
+	c[0], c[1] = c[1], c[0]
+	merged, conflicts = dmx.Merge(base, ours, theirs)
+	if len(conflicts) != 1 || conflicts[0].Kind != dmx.CONFLICT_ATTRIBUTE || conflicts[0].Attribute != "children" || names(merged) != "b,a,c" {
+		t.Error("reorders should conflict", names(merged), conflicts)
+	}
+}
+
+func TestMergeModifyDelete(t *testing.T) {
+	base := dmx.NewDmElement("root", "DmElement")
+	child := dmx.NewDmElement("child", "DmElement")
+	child.CreateIntAttribute("value", 1)
+	base.CreateElementAttribute("child", child)
+
+	modified, _ := dmx.Clone(base, dmx.CloneOptions{PreserveIds: true})
+	c, _ := modified.GetElement("child")
+	c.GetAttribute("value").SetValue(int32(2))
+	deleted, _ := dmx.Clone(base, dmx.CloneOptions{PreserveIds: true})
+	deleted.RemoveAttribute("child")
+
+	// Both directions are reported
+	for _, sides := range [][2]*dmx.DmElement{{modified, deleted}, {deleted, modified}} {
+		_, conflicts := dmx.Merge(base, sides[0], sides[1])
+		if len(conflicts) != 1 || conflicts[0].Kind != dmx.CONFLICT_MODIFY_DELETE || conflicts[0].Id != child.GetId() {
+			t.Error("wrong conflicts", conflicts)
+		}
+	}
+}
+
+func TestObjectId(t *testing.T) {
+	id, err := dmx.NewObjectId()
+	if err != nil || id == dmx.NilObjectId {
+		t.Error("can't create id", err)
+	}
+
+	s := dmx.FormatObjectId(id)
+	id2, err := dmx.ParseObjectId(s)
+	if err != nil || id2 != id {
+		t.Error("wrong parsed id", s, err)
+	}
+	if _, err := dmx.ParseObjectId("not an id"); err == nil {
+		t.Error("invalid id should fail")
+	}
+
+	dns, _ := dmx.ParseObjectId("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	if s := dmx.FormatObjectId(dmx.ObjectIdFromName(dns, "www.example.com")); s != "2ed6657d-e927-568b-95e1-2665a8aea6a2" {
+		t.Error("wrong name based id", s)
+	}
+
+	previous := dmx.SetObjectIdSource(dmx.NewSeededObjectIdSource("test"))
+	a1 := dmx.NewDmElement("a", "DmElement").GetId()
+	a2 := dmx.NewDmElement("b", "DmElement").GetId()
+	dmx.SetObjectIdSource(dmx.NewSeededObjectIdSource("test"))
+	b1 := dmx.NewDmElement("a", "DmElement").GetId()
+	b2 := dmx.NewDmElement("b", "DmElement").GetId()
+	dmx.SetObjectIdSource(previous)
+
+	if a1 != b1 || a2 != b2 || a1 == a2 {
+		t.Error("seeded ids are not reproducible")
+	}
+	if dmx.NewDmElement("c", "DmElement").GetId() == a1 {
+		t.Error("id source not restored")
+	}
+
+	// Elements with a known id don't use the id source
+	root := dmx.NewDmElement("root", "DmElement")
+	root.CreateElementAttribute("child", dmx.NewDmElement("child", "DmElement"))
+	files := make([][]byte, 0)
+	for _, header := range []dmx.DmHeader{
+		{Encoding: "keyvalues2", EncodingVersion: 4, Format: "dmx", FormatVersion: 1},
+		{Encoding: "binary", EncodingVersion: 9, Format: "dmx", FormatVersion: 1},
+	} {
+		buf := new(bytes.Buffer)
+		if err := dmx.Serialize(buf, root, header); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, buf.Bytes())
+	}
+
+	previous = dmx.SetObjectIdSource(dmx.NewSeededObjectIdSource("test"))
+	for _, file := range files {
+		if _, _, err := dmx.Unserialize(bytes.NewReader(file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clone, _ := dmx.Clone(root, dmx.CloneOptions{PreserveIds: true})
+	dmx.Merge(root, clone, root)
+	dmx.NewDmDocument(root, dmx.DmHeader{}).GetPrefix()
+	c1 := dmx.NewDmElement("a", "DmElement").GetId()
+	dmx.SetObjectIdSource(previous)
+	if c1 != a1 {
+		t.Error("known ids used the id source")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	root := dmx.NewDmElement("root", "DmElement")
+	model := dmx.NewDmElement("model", "DmeModel")
+	root.CreateElementAttribute("model", model)
+	children := model.CreateAttribute("children", dmx.AT_ELEMENT_ARRAY)
+	dag1 := dmx.NewDmElement("dag1", "DmeDag")
+	dag2 := dmx.NewDmElement("dag2", "DmeDag")
+	children.PushElement(dag1)
+	children.PushElement(dag2)
+	shape := root.CreateElementAttribute("shape", dag2)
+
+	index := dmx.NewDmIndex(root)
+	if index.Len() != 4 {
+		t.Error("wrong element count", index.Len())
+	}
+	if index.FindById(dag1.GetId()) != dag1 || index.FindByName("model") != model || index.FindByName("missing") != nil {
+		t.Error("wrong lookup")
+	}
+	if dags := index.FindAllByType("DmeDag"); len(dags) != 2 || dags[0] != dag1 || dags[1] != dag2 {
+		t.Error("wrong elements by type", dags)
+	}
+	if refs := index.ReferencesTo(dag2); len(refs) != 2 || refs[0] != shape || refs[1] != children || refs[1].GetOwner() != model {
+		t.Error("wrong references", refs)
+	}
+
+	// Incremental updates
+	dag3 := dmx.NewDmElement("dag3", "DmeDag")
+	children.PushElement(dag3)
+	root.RemoveAttribute("shape")
+	dag1.Name = "renamed"
+	index.Update(model)
+	index.Update(root)
+	index.Update(dag1)
+
+	if len(index.FindAllByType("DmeDag")) != 3 || index.FindByName("dag3") != dag3 {
+		t.Error("added element not indexed")
+	}
+	if index.FindByName("dag1") != nil || index.FindByName("renamed") != dag1 {
+		t.Error("renamed element not reindexed")
+	}
+	if refs := index.ReferencesTo(dag2); len(refs) != 1 || refs[0] != children {
+		t.Error("removed reference still indexed", refs)
+	}
+
+	index.Remove(dag3)
+	if index.FindById(dag3.GetId()) != nil || len(index.FindAllByType("DmeDag")) != 2 {
+		t.Error("removed element still indexed")
+	}
+
+	// Removing an element only unindexes its own references, even detached ones of other elements stay until updated
+	target := dmx.NewDmElement("target", "DmElement")
+	a := root.CreateElementAttribute("a", target)
+	b := dag1.CreateElementAttribute("b", target)
+	index.Update(root)
+	index.Update(dag1)
+	root.RemoveAttribute("a")
+	index.Remove(dag1)
+	if refs := index.ReferencesTo(target); len(refs) != 1 || refs[0] != a {
+		t.Error("wrong references after remove", refs)
+	}
+	// dag1 is still reachable and is indexed again
+	index.Update(root)
+	if refs := index.ReferencesTo(target); len(refs) != 1 || refs[0] != b {
+		t.Error("detached reference still indexed", refs)
+	}
+
+	// Elements sharing an id are found in indexing order
+	twin1 := dmx.NewDmElement("twin1", "DmElement")
+	twin2 := dmx.NewDmElement("twin2", "DmElement")
+	twin2.SetId(twin1.GetId())
+	twins := root.CreateAttribute("twins", dmx.AT_ELEMENT_ARRAY)
+	twins.PushElement(twin1)
+	twins.PushElement(twin2)
+	twins.PushElement(twin1)
+	index.Update(root)
+	if index.FindById(twin1.GetId()) != twin1 {
+		t.Error("wrong element for shared id")
+	}
+	if refs := index.ReferencesTo(twin1); len(refs) != 1 || refs[0] != twins {
+		t.Error("duplicate references", refs)
+	}
+	index.Remove(twin1)
+	if index.FindById(twin1.GetId()) != twin2 {
+		t.Error("wrong element for shared id after remove")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	root := dmx.NewDmElement("root", "DmElement")
+	skeleton := dmx.NewDmElement("skeleton", "DmeModel")
+	root.CreateElementAttribute("skeleton", skeleton)
+	children := skeleton.CreateAttribute("children", dmx.AT_ELEMENT_ARRAY)
+	for i := 0; i < 3; i++ {
+		joint := dmx.NewDmElement("joint"+strconv.Itoa(i), "DmeJoint")
+		transform := dmx.NewDmElement("transform", "DmeTransform")
+		transform.CreateVector3Attribute("position", vector.Vector3[float32]{float32(i), 0, 0})
+		joint.CreateElementAttribute("transform", transform)
+		children.PushElement(joint)
+	}
+	channels := root.CreateAttribute("channels", dmx.AT_ELEMENT_ARRAY)
+	channel := dmx.NewDmElement("rootTransform_p", "DmeChannel")
+	channel.CreateIntAttribute("mode", 3)
+	channels.PushElement(channel)
+	channels.PushElement(dmx.NewDmElement("rootTransform_o", "DmeChannel"))
+	root.CreateAttribute("weights", dmx.AT_FLOAT_ARRAY).SetValue([]float32{1, 2, 3})
+
+	attributes, err := dmx.SelectAttributes(root, "root.skeleton.children[*].transform.position")
+	if err != nil || len(attributes) != 3 {
+		t.Fatal("wrong attributes", attributes, err)
+	}
+	if v, _ := dmx.Get[vector.Vector3[float32]](attributes[2]); v[0] != 2 {
+		t.Error("wrong attribute order", v)
+	}
+
+	elements, err := dmx.SelectElements(root, `//DmeChannel[name="rootTransform_p"]`)
+	if err != nil || len(elements) != 1 || elements[0] != channel {
+		t.Error("wrong recursive query", elements, err)
+	}
+
+	tests := []struct {
+		query string
+		count int
+	}{
+		{"skeleton.children", 1},
+		{"skeleton.children[1]", 1},
+		{"skeleton.children[-1].transform", 1},
+		{"skeleton.children[5]", 0},
+		{"skeleton.children[name=joint2]", 1},
+		{"skeleton.children[name!=joint2]", 2},
+		{"//*", 10},
+		{"//DmeTransform", 3},
+		{"//DmeTransform.position", 3},
+		{"root//DmeJoint.transform[type=DmeTransform]", 3},
+		{"//*[mode=3]", 1},
+		{"//*[mode]", 1},
+		{"channels[*]", 2},
+		{"weights[*]", 3},
+		{"*", 3},
+		{"missing.attribute", 0},
+	}
+	for _, test := range tests {
+		results, err := dmx.Select(root, test.query)
+		if err != nil || len(results) != test.count {
+			t.Error("wrong result count for", test.query, len(results), err)
+		}
+	}
+
+	results, _ := dmx.Select(root, "weights[1]")
+	if len(results) != 1 || results[0].Value() != float32(2) {
+		t.Error("wrong array item", results)
+	}
+
+	for _, query := range []string{"[0]", "a[", "a.", `a[name="x]`, "a]"} {
+		if _, err := dmx.CompileQuery(query); err == nil {
+			t.Error("invalid query should fail", query)
+		}
+	}
+}
+
+func TestDocument(t *testing.T) {
+	root := dmx.NewDmElement("root", "DmElement")
+	child := dmx.NewDmElement("child", "DmElement")
+	root.CreateElementAttribute("child", child)
+	orphan := dmx.NewDmElement("orphan", "DmeOrphan")
+	orphan.CreateElementAttribute("child", child)
+
+	for _, header := range []dmx.DmHeader{
+		{Encoding: "keyvalues2", EncodingVersion: 1, Format: "model", FormatVersion: 22},
+		{Encoding: "keyvalues2_flat", EncodingVersion: 4, Format: "sfm", FormatVersion: 3},
+		{Encoding: "binary", EncodingVersion: 5, Format: "dmx", FormatVersion: 1},
+	} {
+		document := dmx.NewDmDocument(root, header)
+		document.AddElement(orphan)
+		if header.Encoding != "binary" {
+			document.GetPrefix().CreateStringAttribute("asset_info", "test")
+		}
+
+		buf := new(bytes.Buffer)
+		if err := dmx.SerializeDocument(buf, document); err != nil {
+			t.Error(err)
+			continue
+		}
+
+		document2, err := dmx.UnserializeDocument(buf)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if document2.Header != header {
+			t.Error("header not preserved", document2.Header)
+		}
+		if !dmx.Equal(document2.Root, root, dmx.CompareOptions{CompareIds: true}) {
+			t.Error("wrong root", header)
+		}
+
+		elements := document2.Elements()
+		if len(elements) != 3 || elements[2].GetId() != orphan.GetId() {
+			t.Error("orphan element not preserved", header, len(elements))
+			continue
+		}
+		orphanChild, _ := elements[2].GetElement("child")
+		if rootChild, _ := document2.Root.GetElement("child"); orphanChild != rootChild {
+			t.Error("shared element not preserved", header)
+		}
+
+		if header.Encoding != "binary" {
+			if v, _ := document2.GetPrefix().GetString("asset_info"); v != "test" {
+				t.Error("prefix attributes not preserved", header)
+			}
+		}
+
+		document2.RemoveUnreachable()
+		if len(document2.Elements()) != 2 {
+			t.Error("unreachable element not removed")
+		}
+	}
+}
+
+func TestBinaryAttributes(t *testing.T) {
+	root := dmx.NewDmElement("root", "DmElement")
+	blob := []byte{0x00, 0x01, 0xab, 0xff}
+	root.CreateBinaryAttribute("blob", blob)
+	root.CreateBinaryAttribute("empty", nil)
+	blobs := root.CreateAttribute("blobs", dmx.AT_VOID_ARRAY)
+	blobs.PushBinary([]byte{1, 2, 3})
+	blobs.PushBinary([]byte{})
+
+	if v, err := root.GetBinary("blob"); err != nil || !bytes.Equal(v, blob) {
+		t.Error("wrong binary value", v, err)
+	}
+	if s := root.GetAttribute("blob").StringValue(); s != "0001ABFF" {
+		t.Error("wrong binary string", s)
+	}
+	if err := root.GetAttribute("blob").SetValueLenient([]int{1, 2}); err != nil {
+		t.Error(err)
+	}
+	if err := root.GetAttribute("blob").SetValueLenient([]int{256}); err == nil {
+		t.Error("out of range byte should fail")
+	}
+	root.GetAttribute("blob").SetValue(blob)
+
+	clone, _ := dmx.Clone(root, dmx.CloneOptions{})
+	if !dmx.Equal(clone, root, dmx.CompareOptions{}) {
+		t.Error("wrong clone")
+	}
+	v, _ := clone.GetBinaryArray("blobs")
+	v[0][0] = 9
+	if dmx.Equal(clone, root, dmx.CompareOptions{}) {
+		t.Error("clone shares binary values")
+	}
+
+	checkRoundTrip(t, root, dmx.CompareOptions{},
+		dmx.DmHeader{Encoding: "keyvalues2", EncodingVersion: 4, Format: "dmx", FormatVersion: 1},
+		dmx.DmHeader{Encoding: "binary", EncodingVersion: 2, Format: "dmx", FormatVersion: 1},
+		dmx.DmHeader{Encoding: "binary", EncodingVersion: 9, Format: "dmx", FormatVersion: 1},
+	)
+
+	buf := new(bytes.Buffer)
+	if err := dmx.Serialize(buf, root, dmx.DmHeader{Encoding: "keyvalues2", EncodingVersion: 4, Format: "dmx", FormatVersion: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"blob" "binary" "0001ABFF"`) {
+		t.Error("wrong text encoding", buf.String())
+	}
+
+	text := `<!-- dmx encoding keyvalues2 4 format dmx 1 -->
+"DmElement"
+{
+	"id" "elementid" "8a4bd72f-6b2f-4eb3-a0ac-b8fe25bd3b97"
+	"blob" "binary" "
+		0001
+		ABff
+	"
+}
+`
+	root3, _, err := dmx.Unserialize(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := root3.GetBinary("blob"); !bytes.Equal(v, blob) {
+		t.Error("wrong multiline binary value", v)
+	}
+}
+
+func TestAllAttributeTypes(t *testing.T) {
+	e1 := dmx.NewDmElement("e1", "DmElement")
+	e2 := dmx.NewDmElement("e2", "DmElement")
+	e3 := dmx.NewDmElement("e3", "DmElement")
+	m := [16]float32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	// Item values for each value type, the first one is used for the scalar attribute
+	tests := []struct {
+		name          string
+		attributeType dmx.DmAttributeType
+		items         []interface{}
+	}{
+		{"element", dmx.AT_ELEMENT, []interface{}{e1, e2, e3}},
+		{"int", dmx.AT_INT, []interface{}{int32(-1), int32(2), int32(3)}},
+		{"float", dmx.AT_FLOAT, []interface{}{float32(0.5), float32(-1.25), float32(1e-7)}},
+		{"bool", dmx.AT_BOOL, []interface{}{true, false, true}},
+		{"string", dmx.AT_STRING, []interface{}{"a", "b c", ""}},
+		{"binary", dmx.AT_VOID, []interface{}{[]byte{1, 2}, []byte{}, []byte{0xff}}},
+		{"time", dmx.AT_TIME, []interface{}{dmx.DmTimeFromSeconds(1.5), dmx.DmTime(0), dmx.DmTimeFromSeconds(-2)}},
+		{"color", dmx.AT_COLOR, []interface{}{[4]byte{1, 2, 3, 4}, [4]byte{255, 0, 0, 255}, [4]byte{}}},
+		{"vector2", dmx.AT_VECTOR2, []interface{}{vector.Vector2[float32]{1, 2}, vector.Vector2[float32]{3, 4}, vector.Vector2[float32]{}}},
+		{"vector3", dmx.AT_VECTOR3, []interface{}{vector.Vector3[float32]{1, 2, 3}, vector.Vector3[float32]{4, 5, 6}, vector.Vector3[float32]{}}},
+		{"vector4", dmx.AT_VECTOR4, []interface{}{vector.Vector4[float32]{1, 2, 3, 4}, vector.Vector4[float32]{5, 6, 7, 8}, vector.Vector4[float32]{}}},
+		{"qangle", dmx.AT_QANGLE, []interface{}{vector.Vector3[float32]{90, 0, 45}, vector.Vector3[float32]{0, 180, 0}, vector.Vector3[float32]{}}},
+		{"quaternion", dmx.AT_QUATERNION, []interface{}{vector.Quaternion[float32]{0, 0, 0, 1}, vector.Quaternion[float32]{0.5, 0.5, 0.5, 0.5}, vector.Quaternion[float32]{}}},
+		{"matrix", dmx.AT_VMATRIX, []interface{}{m, [16]float32{}, [16]float32{1}}},
+		{"uint64", dmx.AT_UINT64, []interface{}{uint64(1 << 40), uint64(0), uint64(7)}},
+	}
+
+	root := dmx.NewDmElement("root", "DmElement")
+	for _, test := range tests {
+		name := test.name
+		arrayType := test.attributeType - dmx.AT_FIRST_VALUE_TYPE + dmx.AT_FIRST_ARRAY_TYPE
+
+		scalar := root.CreateAttribute(name, test.attributeType)
+		if err := scalar.SetValue(test.items[0]); err != nil {
+			t.Error(name, err)
+		}
+		if scalar.StringValue() == "" && test.attributeType != dmx.AT_STRING {
+			t.Error("empty string value for", name)
+		}
+
+		array := root.CreateAttribute(name+"_array", arrayType)
+		if err := array.SetValues(test.items[0], test.items[2]); err != nil {
+			t.Error(name, err)
+		}
+		if err := array.InsertAt(1, test.items[1]); err != nil || array.Len() != 3 {
+			t.Error("InsertAt failed for", name, err)
+		}
+		if err := array.InsertAt(3, test.items[2]); err != nil || array.Len() != 4 {
+			t.Error("InsertAt at the end failed for", name, err)
+		}
+		if err := array.RemoveAt(3); err != nil || array.Len() != 3 {
+			t.Error("RemoveAt failed for", name, err)
+		}
+		if err := array.SetAt(2, test.items[2]); err != nil {
+			t.Error("SetAt failed for", name, err)
+		}
+		for i, item := range test.items {
+			if v, err := array.At(i); err != nil || !dmx.Equal(wrapValue(test.attributeType, v), wrapValue(test.attributeType, item), dmx.CompareOptions{}) {
+				t.Error("wrong item", i, "for", name, v, err)
+			}
+		}
+		if _, err := array.At(3); err == nil {
+			t.Error("At out of range should fail for", name)
+		}
+		if err := array.SetAt(0, "wrong type"); err == nil && test.attributeType != dmx.AT_STRING {
+			t.Error("SetAt with a wrong type should fail for", name)
+		}
+		if s := array.StringValue(); !strings.HasPrefix(s, "[") {
+			t.Error("wrong array string value for", name, s)
+		}
+	}
+
+	if err := root.GetAttribute("element_array").InsertAt(0, (*dmx.DmElement)(nil)); err == nil {
+		t.Error("element arrays should not accept nil elements")
+	}
+	if err := root.GetAttribute("int").RemoveAt(0); err == nil {
+		t.Error("RemoveAt on a scalar should fail")
+	}
+	root.GetAttribute("matrix_array").PushMatrix(m)
+	root.GetAttribute("qangle_array").PushQAngle(vector.Vector3[float32]{1, 2, 3})
+	root.GetAttribute("matrix_array").RemoveAt(3)
+	root.GetAttribute("qangle_array").RemoveAt(3)
+
+	// Same graph without the types missing from older binary encodings
+	legacy, _ := dmx.Clone(root, dmx.CloneOptions{PreserveIds: true})
+	legacy.RemoveAttribute("uint64")
+	legacy.RemoveAttribute("uint64_array")
+
+	checkRoundTrip(t, root, dmx.CompareOptions{CompareIds: true},
+		dmx.DmHeader{Encoding: "keyvalues2", EncodingVersion: 4, Format: "dmx", FormatVersion: 1},
+		dmx.DmHeader{Encoding: "keyvalues2_flat", EncodingVersion: 4, Format: "dmx", FormatVersion: 1},
+		dmx.DmHeader{Encoding: "binary", EncodingVersion: 9, Format: "dmx", FormatVersion: 1},
+	)
+	checkRoundTrip(t, legacy, dmx.CompareOptions{CompareIds: true},
+		dmx.DmHeader{Encoding: "binary", EncodingVersion: 5, Format: "dmx", FormatVersion: 1},
+		dmx.DmHeader{Encoding: "binary", EncodingVersion: 3, Format: "dmx", FormatVersion: 1},
+	)
+}
+
+// checkRoundTrip serializes root with each header, reads it back and reports the differences.
+// It returns the roots read back, nil for the failed ones.
+func checkRoundTrip(t *testing.T, root *dmx.DmElement, options dmx.CompareOptions, headers ...dmx.DmHeader) []*dmx.DmElement {
+	t.Helper()
+
+	roots := make([]*dmx.DmElement, len(headers))
+	for k, header := range headers {
+		buf := new(bytes.Buffer)
+		if err := dmx.Serialize(buf, root, header); err != nil {
+			t.Error(header, err)
+			continue
+		}
+		root2, _, err := dmx.Unserialize(buf)
+		if err != nil {
+			t.Error(header, err)
+			continue
+		}
+		if !dmx.Equal(root2, root, options) {
+			t.Error(header, "round trip changed the document")
+			for _, d := range dmx.Diff(root, root2, options) {
+				t.Error(header, d.Kind, d.Path, d.Attribute, d.OldValue, d.NewValue)
+			}
+		}
+		roots[k] = root2
+	}
+	return roots
+}
+
+// wrapValue stores a value in an element to compare it with dmx.Equal
+func wrapValue(attributeType dmx.DmAttributeType, value interface{}) *dmx.DmElement {
+	e := dmx.NewDmElement("", "")
+	e.CreateAttribute("value", attributeType).SetValue(value)
+	return e
+}
+
+func TestTextEscaping(t *testing.T) {
+	tricky := []string{
+		`C:\Program Files (x86)\Steam\steamapps\common\SourceFilmmaker\game\usermod\elements\sessions\my "best" shot.dmx`,
+		"line 1\nline 2\ttabbed",
+		`\\server\share\`,
+		`"`,
+		"Привет, мир — «ciné» 日本語",
+		`ends with a backslash \`,
+		"",
+	}
+
+	root := dmx.NewDmElement(`shot "1" \ take 2`, "DmeFilmClip")
+	root.CreateStringAttribute(`odd "name"`+"\t", "value")
+	strs := root.CreateAttribute("strings", dmx.AT_STRING_ARRAY)
+	for k, s := range tricky {
+		root.CreateStringAttribute("s"+strconv.Itoa(k), s)
+		strs.PushString(s)
+	}
+	child := dmx.NewDmElement("child\n\"quoted\"", "DmElement")
+	root.CreateElementAttribute("child", child)
+	root.CreateElementAttribute("shared", child)
+
+	for _, flat := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		var err error
+		if flat {
+			err = dmx.SerializeTextFlat(buf, root, "sfm_session", 22)
+		} else {
+			err = dmx.SerializeText(buf, root, "sfm_session", 22)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		root2, _, err := dmx.Unserialize(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !dmx.Equal(root2, root, dmx.CompareOptions{CompareIds: true}) {
+			for _, d := range dmx.Diff(root, root2, dmx.CompareOptions{}) {
+				t.Error(d.Kind, d.Path, d.Attribute, d.OldValue, d.NewValue)
+			}
+		}
+	}
+
+	// Backslashes that are not escape sequences are kept
+	text := `<!-- dmx encoding keyvalues2 1 format sfm 1 -->
+"DmElement"
+{
+	"id" "elementid" "8a4bd72f-6b2f-4eb3-a0ac-b8fe25bd3b97"
+	"path" "string" "C:\sfm\usermod\x\"b\".dmx"
+}
+`
+	root3, _, err := dmx.Unserialize(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := root3.GetString("path"); v != `C:\sfm\usermod\x"b".dmx` {
+		t.Error("wrong unescaped string", v)
+	}
+}
+
+func TestDmTime(t *testing.T) {
+	if v := dmx.DmTimeFromSeconds(0.1); v != 1000 {
+		t.Error("wrong time from seconds", v)
+	}
+	if v := dmx.DmTimeFromSeconds(float64(float32(0.1))); v != 1000 {
+		t.Error("float32 seconds should round to the nearest tick", v)
+	}
+	if v := dmx.DmTimeFromSeconds(-0.000151); v != -2 {
+		t.Error("wrong rounding of negative times", v)
+	}
+	if v := dmx.DmTimeFromSeconds(1e9); v != dmx.DMTIME_MAX {
+		t.Error("time should be clamped", v)
+	}
+	if v := dmx.DmTimeFromDuration(1500*time.Millisecond + 49*time.Microsecond); v != 15000 {
+		t.Error("wrong time from duration", v)
+	}
+	if d := dmx.DmTime(15001).Duration(); d != 1500100*time.Microsecond {
+		t.Error("wrong duration", d)
+	}
+	for _, frameRate := range []float64{24, 30, 29.97, 60} {
+		for frame := -100; frame < 1000; frame++ {
+			if f := dmx.DmTimeFromFrame(frame, frameRate).Frame(frameRate); f != frame {
+				t.Error("wrong frame", frame, f, frameRate)
+				break
+			}
+		}
+	}
+	for _, frameRate := range []float64{0, -24, math.NaN(), math.Inf(1)} {
+		if v := dmx.DmTimeFromFrame(5, frameRate); v != 0 {
+			t.Error("wrong time for invalid frame rate", frameRate, v)
+		}
+		if f := dmx.DmTimeFromSeconds(1).Frame(frameRate); f != 0 {
+			t.Error("wrong frame for invalid frame rate", frameRate, f)
+		}
+	}
+	if s := dmx.DmTimeFromSeconds(0.1).String(); s != "0.1" {
+		t.Error("wrong time string", s)
+	}
+
+	root := dmx.NewDmElement("root", "DmElement")
+	root.CreateTimeAttribute("start", dmx.DmTimeFromSeconds(0.1))
+	times := root.CreateAttribute("times", dmx.AT_TIME_ARRAY)
+	times.PushTime(dmx.DmTimeFromFrame(1, 24))
+	times.PushTime(dmx.DMTIME_MIN)
+	if err := times.SetValuesLenient(0.3, 2*time.Second); err != nil {
+		t.Error(err)
+	}
+	if v, _ := root.GetTimeArray("times"); len(v) != 2 || v[0] != 3000 || v[1] != 20000 {
+		t.Error("wrong lenient times", v)
+	}
+
+	// Conversions between times and numbers are in seconds
+	conversions := dmx.NewDmElement("conversions", "DmElement")
+	conversions.CreateTimeAttribute("float", dmx.DmTimeFromSeconds(1.5))
+	conversions.CreateIntAttribute("int", 5)
+	conversions.CreateTimeAttribute("fraction", dmx.DmTimeFromSeconds(1.5))
+	if err := conversions.ChangeAttributeType("float", dmx.AT_FLOAT); err != nil {
+		t.Error(err)
+	}
+	if v, _ := conversions.GetFloat("float"); v != 1.5 {
+		t.Error("wrong time to float", v)
+	}
+	if err := conversions.ChangeAttributeType("float", dmx.AT_TIME); err != nil {
+		t.Error(err)
+	}
+	if v, _ := conversions.GetTime("float"); v != dmx.DmTimeFromSeconds(1.5) {
+		t.Error("wrong float to time", v)
+	}
+	if err := conversions.ChangeAttributeType("int", dmx.AT_TIME); err != nil {
+		t.Error(err)
+	}
+	if err := conversions.ChangeAttributeType("int", dmx.AT_INT); err != nil {
+		t.Error(err)
+	}
+	if v, _ := conversions.GetInt("int"); v != 5 {
+		t.Error("wrong int to time to int", v)
+	}
+	if err := conversions.ChangeAttributeType("fraction", dmx.AT_INT); err == nil {
+		t.Error("fractional seconds should not convert to int")
+	}
+	times.PushTime(dmx.DMTIME_MIN)
+
+	for _, root2 := range checkRoundTrip(t, root, dmx.CompareOptions{},
+		dmx.DmHeader{Encoding: "keyvalues2", EncodingVersion: 4, Format: "dmx", FormatVersion: 1},
+		dmx.DmHeader{Encoding: "binary", EncodingVersion: 9, Format: "dmx", FormatVersion: 1},
+	) {
+		if root2 == nil {
+			continue
+		}
+		if v, _ := root2.GetTime("start"); v != 1000 {
+			t.Error("wrong time after round trip", v)
+		}
+	}
+}
+
+func TestColor(t *testing.T) {
+	c := dmx.NewColor(255, 128, 0, 128)
+	if c.R() != 255 || c.G() != 128 || c.B() != 0 || c.A() != 128 {
+		t.Error("wrong components", c)
+	}
+	if n := c.NRGBA(); n != (color.NRGBA{255, 128, 0, 128}) {
+		t.Error("wrong NRGBA", n)
+	}
+	if p := c.PremultipliedRGBA(); p != (color.RGBA{128, 64, 0, 128}) {
+		t.Error("wrong premultiplied RGBA", p)
+	}
+	if c2 := dmx.ColorFromColor(color.RGBA{128, 64, 0, 255}); c2 != dmx.NewColor(128, 64, 0, 255) {
+		t.Error("wrong color from RGBA", c2)
+	}
+	if c2 := dmx.ColorFromColor(color.Gray{200}); c2 != dmx.NewColor(200, 200, 200, 255) {
+		t.Error("wrong color from gray", c2)
+	}
+
+	if h := c.Hex(); h != "#ff800080" {
+		t.Error("wrong hex", h)
+	}
+	for s, expected := range map[string]dmx.Color{
+		"#ff800080": c,
+		"FF8000":    dmx.NewColor(255, 128, 0, 255),
+		"#f80":      dmx.NewColor(255, 136, 0, 255),
+		"#f808":     dmx.NewColor(255, 136, 0, 136),
+	} {
+		if c2, err := dmx.ParseColor(s); err != nil || c2 != expected {
+			t.Error("wrong parsed color", s, c2, err)
+		}
+	}
+	for _, s := range []string{"", "#ff800", "#gg8000"} {
+		if _, err := dmx.ParseColor(s); err == nil {
+			t.Error("invalid color parsed", s)
+		}
+	}
+
+	if f := dmx.NewColor(255, 0, 51, 255).Floats(); f != (vector.Vector4[float32]{1, 0, 0.2, 1}) {
+		t.Error("wrong floats", f)
+	}
+	if c2 := dmx.ColorFromFloats(vector.Vector4[float32]{2, -1, 0.2, 1}); c2 != dmx.NewColor(255, 0, 51, 255) {
+		t.Error("wrong color from floats", c2)
+	}
+	if l := dmx.NewColor(188, 0, 255, 255).LinearFloats(); l[0] < 0.49 || l[0] > 0.51 || l[2] != 1 || l[3] != 1 {
+		t.Error("wrong linear floats", l)
+	}
+	for i := 0; i < 256; i++ {
+		c2 := dmx.NewColor(byte(i), byte(255-i), byte(i/2), byte(i))
+		if c3 := dmx.ColorFromLinearFloats(c2.LinearFloats()); c3 != c2 {
+			t.Error("wrong linear round trip", c2, c3)
+		}
+	}
+
+	root := dmx.NewDmElement("root", "DmElement")
+	root.CreateColorAttribute("legacy", [4]byte{1, 2, 3, 4})
+	root.CreateColorAttribute("color", c)
+	colors := root.CreateAttribute("colors", dmx.AT_COLOR_ARRAY)
+	colors.PushColor([4]byte{5, 6, 7, 8})
+	colors.PushColor(c)
+	if err := root.CreateAttribute("legacy", dmx.AT_COLOR).SetValue([4]byte{9, 10, 11, 12}); err != nil {
+		t.Error(err)
+	}
+	if err := colors.InsertAt(0, [4]byte{13, 14, 15, 16}); err != nil {
+		t.Error(err)
+	}
+	if err := root.CreateAttribute("lenient", dmx.AT_COLOR).SetValueLenient(color.NRGBA{1, 2, 3, 4}); err != nil {
+		t.Error(err)
+	}
+	if v, err := root.GetColor("legacy"); err != nil || v != dmx.NewColor(9, 10, 11, 12) {
+		t.Error("wrong color", v, err)
+	}
+	if v, err := root.GetColor("lenient"); err != nil || v != dmx.NewColor(1, 2, 3, 4) {
+		t.Error("wrong lenient color", v, err)
+	}
+	if v, _ := root.GetColorArray("colors"); len(v) != 3 || v[0] != dmx.NewColor(13, 14, 15, 16) || v[2] != c {
+		t.Error("wrong colors", v)
+	}
+	if v, err := dmx.Get[[4]byte](root.CreateAttribute("legacy", dmx.AT_COLOR)); err != nil || v != [4]byte{9, 10, 11, 12} {
+		t.Error("wrong legacy color", v, err)
+	}
+	if v, err := dmx.Get[[][4]byte](colors); err != nil || len(v) != 3 || v[0] != [4]byte{13, 14, 15, 16} {
+		t.Error("wrong legacy colors", v, err)
+	}
+
+	checkRoundTrip(t, root, dmx.CompareOptions{},
+		dmx.DmHeader{Encoding: "keyvalues2", EncodingVersion: 4, Format: "dmx", FormatVersion: 1},
+		dmx.DmHeader{Encoding: "binary", EncodingVersion: 9, Format: "dmx", FormatVersion: 1},
+	)
+}